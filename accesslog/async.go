@@ -0,0 +1,153 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DropPolicy decides what happens to a line written to a full AsyncWriter.
+type DropPolicy string
+
+const (
+	// DropNewest discards the line being written.
+	DropNewest DropPolicy = "newest"
+
+	// DropOldest discards the oldest queued line to make room.
+	DropOldest DropPolicy = "oldest"
+
+	// DropNone waits for room, so a slow sink holds up requests.
+	DropNone DropPolicy = "none"
+)
+
+// DefaultBufferSize is the number of lines an AsyncWriter queues if no size is
+// given.
+const DefaultBufferSize = 1024
+
+// ParseDropPolicy checks a drop policy name. The default is DropNewest.
+func ParseDropPolicy(name string) (DropPolicy, error) {
+	if name == "" {
+		return DropNewest, nil
+	}
+
+	switch policy := DropPolicy(name); policy {
+	case DropNewest, DropOldest, DropNone:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown access log drop policy %q", name)
+}
+
+// AsyncWriter queues lines in a buffer and writes them to an underlying
+// writer in the background, so that a slow sink doesn't hold up requests.
+type AsyncWriter struct {
+	// dropped is updated atomically, so it comes first to keep it 64-bit aligned.
+	dropped uint64
+
+	w      io.Writer
+	policy DropPolicy
+	onDrop func()
+
+	lines chan []byte
+	done  chan struct{}
+
+	// mu guards closing lines against writes still in progress.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewAsyncWriter starts writing to w in the background, with room for size
+// queued lines, or DefaultBufferSize if size isn't positive. onDrop, if set,
+// is called for each line dropped.
+func NewAsyncWriter(w io.Writer, size int, policy DropPolicy, onDrop func()) *AsyncWriter {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	a := &AsyncWriter{
+		w:      w,
+		policy: policy,
+		onDrop: onDrop,
+		lines:  make(chan []byte, size),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncWriter) run() {
+	defer close(a.done)
+	for line := range a.lines {
+		if _, err := a.w.Write(line); err != nil {
+			log.Errorln("Error writing access log:", err)
+		}
+	}
+}
+
+// Write queues a copy of p, dropping a line as the policy says if the queue
+// is full, or dropping p once the writer is closed. It never returns an
+// error.
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.drop()
+		return len(p), nil
+	}
+
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	if a.policy == DropNone {
+		a.lines <- line
+		return len(p), nil
+	}
+
+	for {
+		select {
+		case a.lines <- line:
+			return len(p), nil
+		default:
+		}
+
+		if a.policy == DropNewest {
+			a.drop()
+			return len(p), nil
+		}
+
+		// Make room by discarding the oldest line, then try again.
+		select {
+		case <-a.lines:
+			a.drop()
+		default:
+		}
+	}
+}
+
+func (a *AsyncWriter) drop() {
+	atomic.AddUint64(&a.dropped, 1)
+	if a.onDrop != nil {
+		a.onDrop()
+	}
+}
+
+// Dropped gets the number of lines dropped so far.
+func (a *AsyncWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Close writes out the queued lines and stops. Lines written afterwards are
+// dropped.
+func (a *AsyncWriter) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.lines)
+	}
+	a.mu.Unlock()
+
+	<-a.done
+	return nil
+}
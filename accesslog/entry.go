@@ -0,0 +1,131 @@
+package accesslog
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Entry holds details about how a request was handled that only the wrapped
+// handler knows. The logging handlers add an empty entry to the request
+// context for the wrapped handler to fill in.
+type Entry struct {
+	// Host is the host the request was made to, before any rewriting.
+	Host string
+
+	// hostTag is set by SetHostTag.
+	hostTag string
+
+	// RouteKind describes how the request was routed, e.g. "service" or
+	// "redirect", and Prefix is the path prefix of the matched route.
+	RouteKind, Prefix string
+
+	// Variant is the target chosen for a route that splits traffic.
+	Variant string
+
+	// Upstream, UpstreamStatus and UpstreamDuration describe the upstream
+	// response, if the request was proxied. The duration runs until the
+	// response headers were received.
+	Upstream         string
+	UpstreamStatus   int
+	UpstreamDuration time.Duration
+
+	// SemaphoreWait is the time spent waiting for a slot under the upstream's
+	// concurrency limit.
+	SemaphoreWait time.Duration
+
+	// The remaining fields are set by the logging handler once the request
+	// has been handled. Duration is the total time taken, and TTFB the time
+	// until the response headers were written.
+	Start          time.Time
+	Status, Size   int
+	Duration, TTFB time.Duration
+}
+
+// Recorder is called by the logging handlers with the entry for each request
+// once it has been handled, e.g. to send metrics.
+type Recorder func(req *http.Request, entry *Entry)
+
+type entryKey struct{}
+
+// withEntry returns a shallow copy of req with a new entry in its context.
+func withEntry(req *http.Request) (*http.Request, *Entry) {
+	entry := &Entry{Host: req.Host, Start: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), entryKey{}, entry)), entry
+}
+
+// serveLogged serves req with h, filling in a new entry as it goes.
+func serveLogged(h http.Handler, recorder Recorder, w http.ResponseWriter, req *http.Request) (*http.Request, *Entry) {
+	logger := makeLogger(w)
+	req, entry := withEntry(req)
+	h.ServeHTTP(logger, req)
+
+	entry.Status = logger.Status()
+	entry.Size = logger.Size()
+	entry.Duration = time.Since(entry.Start)
+	if firstByte := logger.FirstByte(); !firstByte.IsZero() {
+		entry.TTFB = firstByte.Sub(entry.Start)
+	}
+
+	if recorder != nil {
+		recorder(req, entry)
+	}
+	return req, entry
+}
+
+// GetEntry gets the entry for a request. It returns nil if the request isn't
+// being logged, which the Entry setters allow for.
+func GetEntry(req *http.Request) *Entry {
+	entry, _ := req.Context().Value(entryKey{}).(*Entry)
+	return entry
+}
+
+// SetRoute records how a request was routed.
+func (e *Entry) SetRoute(kind, prefix string) {
+	if e != nil {
+		e.RouteKind = kind
+		e.Prefix = prefix
+	}
+}
+
+// SetHostTag records the host a request is tagged with in metrics. It's only
+// set for hosts the proxy is configured for, so that requests for arbitrary
+// hosts can't create new series.
+func (e *Entry) SetHostTag(host string) {
+	if e != nil {
+		e.hostTag = host
+	}
+}
+
+// HostTag gets the host a request is tagged with in metrics, or "other" if it
+// wasn't set.
+func (e *Entry) HostTag() string {
+	if e == nil || e.hostTag == "" {
+		return "other"
+	}
+	return e.hostTag
+}
+
+// SetVariant records the target chosen for a request.
+func (e *Entry) SetVariant(variant string) {
+	if e != nil {
+		e.Variant = variant
+	}
+}
+
+// SetUpstream records the upstream response to a request.
+func (e *Entry) SetUpstream(host string, status int, duration time.Duration) {
+	if e != nil {
+		e.Upstream = host
+		e.UpstreamStatus = status
+		e.UpstreamDuration = duration
+	}
+}
+
+// SetSemaphoreWait records the time a request waited for the upstream's
+// concurrency limit.
+func (e *Entry) SetSemaphoreWait(wait time.Duration) {
+	if e != nil {
+		e.SemaphoreWait = wait
+	}
+}
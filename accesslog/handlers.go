@@ -9,6 +9,7 @@ package accesslog
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -16,6 +17,8 @@ import (
 	"strconv"
 	"time"
 	"unicode/utf8"
+
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/forwarded"
 )
 
 // combinedLoggingHandler is the http.Handler implementation for LoggingHandlerTo
@@ -23,30 +26,32 @@ import (
 type combinedLoggingHandler struct {
 	writer  io.Writer
 	handler http.Handler
+	options Options
 }
 
 // customLoggingHandlerHandler is our extended version of combinedLoggingHandler
 type customLoggingHandler struct {
 	writer  io.Writer
 	handler http.Handler
+	options Options
 }
 
-
 func (h combinedLoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	t := time.Now()
-	logger := makeLogger(w)
 	url := *req.URL
-	h.handler.ServeHTTP(logger, req)
-	writeCombinedLog(h.writer, req, url, t, logger.Status(), logger.Size())
+	originalHost := req.Host
+	req, entry := serveLogged(h.handler, h.options.Recorder, w, req)
+	if req, url, ok := h.options.apply(req, url, originalHost, entry); ok {
+		writeCombinedLog(h.writer, req, url, entry.Start, entry.Status, entry.Size)
+	}
 }
 
 func (h customLoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	t := time.Now()
-	logger := makeLogger(w)
 	url := *req.URL
 	originalHost := req.Host
-	h.handler.ServeHTTP(logger, req)
-	writeCustomLog(h.writer, req, url, t, logger.Status(), logger.Size(), originalHost)
+	req, entry := serveLogged(h.handler, h.options.Recorder, w, req)
+	if req, url, ok := h.options.apply(req, url, originalHost, entry); ok {
+		writeCustomLog(h.writer, req, url, entry.Start, entry.Status, entry.Size, originalHost)
+	}
 }
 
 func makeLogger(w http.ResponseWriter) loggingResponseWriter {
@@ -70,14 +75,16 @@ type loggingResponseWriter interface {
 	http.Flusher
 	Status() int
 	Size() int
+	FirstByte() time.Time
 }
 
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP
-// status code and body size
+// status code, body size and when the response began
 type responseLogger struct {
-	w      http.ResponseWriter
-	status int
-	size   int
+	w         http.ResponseWriter
+	status    int
+	size      int
+	firstByte time.Time
 }
 
 func (l *responseLogger) Header() http.Header {
@@ -88,6 +95,7 @@ func (l *responseLogger) Write(b []byte) (int, error) {
 	if l.status == 0 {
 		// The status will be StatusOK if WriteHeader has not been called yet
 		l.status = http.StatusOK
+		l.firstByte = time.Now()
 	}
 	size, err := l.w.Write(b)
 	l.size += size
@@ -96,6 +104,9 @@ func (l *responseLogger) Write(b []byte) (int, error) {
 
 func (l *responseLogger) WriteHeader(s int) {
 	l.w.WriteHeader(s)
+	if l.status == 0 {
+		l.firstByte = time.Now()
+	}
 	l.status = s
 }
 
@@ -107,6 +118,10 @@ func (l *responseLogger) Size() int {
 	return l.size
 }
 
+func (l *responseLogger) FirstByte() time.Time {
+	return l.firstByte
+}
+
 func (l *responseLogger) Flush() {
 	f, ok := l.w.(http.Flusher)
 	if ok {
@@ -218,11 +233,7 @@ func buildCommonLogLine(req *http.Request, url url.URL, ts time.Time, status int
 		}
 	}
 
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-
-	if err != nil {
-		host = req.RemoteAddr
-	}
+	host := forwarded.ClientIP(req)
 
 	uri := req.RequestURI
 
@@ -284,33 +295,38 @@ func writeCombinedLog(w io.Writer, req *http.Request, url url.URL, ts time.Time,
 //
 // LoggingHandler always sets the ident field of the log to -
 func CombinedLoggingHandler(out io.Writer, h http.Handler) http.Handler {
-	return combinedLoggingHandler{out, h}
+	return combinedLoggingHandler{writer: out, handler: h}
 }
 
-
-
 // writeCustomLog builds upon writeCombinedLog and adds the following fields
 // - original hostname of request
 // - new proxied hostname
 // - SRCIP (added to request by a custom front end balancer)
 // - X-Forwarded-For (added to request by other front end balancer)
+// and, after the referer and user agent, the following timings in milliseconds
+// (or - if unknown)
+// - total duration
+// - time to first byte
+// - time waiting on the upstream concurrency limit
+// - upstream round trip, until the response headers were received
+// and finally the target chosen, if the route split traffic.
 func writeCustomLog(w io.Writer, req *http.Request, url url.URL, ts time.Time, status, size int, originalHost string) {
 	buf := buildCommonLogLine(req, url, ts, status, size)
-	
+
 	buf = append(buf, ` `...)
 	if originalHost != "" {
-		buf = appendQuoted(buf, originalHost)	
+		buf = appendQuoted(buf, originalHost)
 	} else {
 		buf = append(buf, `-`...)
 	}
-	
+
 	buf = append(buf, ` `...)
 	if req.URL.Host != "" {
 		buf = appendQuoted(buf, req.URL.Host)
 	} else {
 		buf = append(buf, `-`...)
 	}
-	
+
 	buf = append(buf, ` `...)
 	if req.Header.Get("SRCIP") != "" {
 		buf = appendQuoted(buf, req.Header.Get("SRCIP"))
@@ -329,10 +345,101 @@ func writeCustomLog(w io.Writer, req *http.Request, url url.URL, ts time.Time, s
 	buf = appendQuoted(buf, req.Referer())
 	buf = append(buf, `" "`...)
 	buf = appendQuoted(buf, req.UserAgent())
-	buf = append(buf, '"', '\n')
+	buf = append(buf, '"')
+
+	entry := GetEntry(req)
+	if entry != nil {
+		buf = appendMilliseconds(buf, entry.Duration, entry.Duration > 0)
+		buf = appendMilliseconds(buf, entry.TTFB, entry.TTFB > 0)
+		buf = appendMilliseconds(buf, entry.SemaphoreWait, entry.UpstreamStatus != 0)
+		buf = appendMilliseconds(buf, entry.UpstreamDuration, entry.UpstreamStatus != 0)
+	} else {
+		buf = append(buf, ` - - - -`...)
+	}
+
+	buf = append(buf, ` `...)
+	if id := req.Header.Get("X-Request-ID"); id != "" {
+		buf = appendQuoted(buf, id)
+	} else {
+		buf = append(buf, `-`...)
+	}
+
+	// The variant is always written, as - if there isn't one, so that every
+	// line has the same number of fields.
+	buf = append(buf, ` `...)
+	if entry != nil && entry.Variant != "" {
+		buf = appendQuoted(buf, entry.Variant)
+	} else {
+		buf = append(buf, `-`...)
+	}
+
+	buf = append(buf, '\n')
 	w.Write(buf)
 }
 
 func CustomLoggingHandler(out io.Writer, h http.Handler) http.Handler {
-	return customLoggingHandler{out, h}
+	return customLoggingHandler{writer: out, handler: h}
+}
+
+// appendMilliseconds appends a space and a duration in milliseconds, or - if
+// the duration isn't known.
+func appendMilliseconds(buf []byte, d time.Duration, known bool) []byte {
+	buf = append(buf, ' ')
+	if !known {
+		return append(buf, '-')
+	}
+	return strconv.AppendFloat(buf, float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// Access log formats.
+const (
+	FormatCustom   = "custom"
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+)
+
+// Options configure the logging handlers returned by NewHandler.
+type Options struct {
+	// Format is the access log format, which defaults to custom.
+	Format string
+
+	// Fields lists the fields of JSON access logs.
+	Fields []string
+
+	// Recorder, if set, is called with the entry for each request after it's
+	// been handled.
+	Recorder Recorder
+
+	// Rules, if set, filter and redact requests before they're written.
+	Rules RuleSet
+}
+
+// apply applies the rules for the original host of a request, reporting
+// whether it should be written and redacting it if so.
+func (o Options) apply(req *http.Request, url url.URL, originalHost string, entry *Entry) (*http.Request, url.URL, bool) {
+	if o.Rules == nil {
+		return req, url, true
+	}
+
+	rules := o.Rules.For(originalHost)
+	if !rules.Keep(req, url.Path, entry.Status) {
+		return req, url, false
+	}
+
+	req, url = rules.Redact(req, url)
+	return req, url, true
+}
+
+// NewHandler returns a http.Handler that wraps h and logs requests to out as
+// described by options.
+func NewHandler(out io.Writer, options Options, h http.Handler) (http.Handler, error) {
+	switch options.Format {
+	case FormatCustom, "":
+		return customLoggingHandler{writer: out, handler: h, options: options}, nil
+	case FormatCombined:
+		return combinedLoggingHandler{writer: out, handler: h, options: options}, nil
+	case FormatJSON:
+		return jsonLoggingHandler{writer: out, handler: h, options: options}, nil
+	}
+	return nil, fmt.Errorf("unknown access log format %q", options.Format)
 }
@@ -9,9 +9,15 @@ package accesslog
 
 import (
 	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -158,8 +164,247 @@ func TestWriteCustomLog(t *testing.T) {
 
 	expected := "192.168.100.5 - - [26/May/1983:03:30:45 +0200] \"GET / HTTP/1.1\" 200 100 example.org example.com 10.0.0.0 127.0.0.1, 127.0.0.1 \"http://example.com\" " +
 		"\"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_8_2) " +
-		"AppleWebKit/537.33 (KHTML, like Gecko) Chrome/27.0.1430.0 Safari/537.33\"\n"
+		"AppleWebKit/537.33 (KHTML, like Gecko) Chrome/27.0.1430.0 Safari/537.33\" - - - - - -\n"
+	if log != expected {
+		t.Fatalf("wrong log, got %q want %q", log, expected)
+	}
+
+	// A proxied request with timings and a request ID
+	req.Header.Set("X-Request-ID", "abc123")
+	req, entry := withEntry(req)
+	entry.Duration = 12 * time.Millisecond
+	entry.TTFB = 11500 * time.Microsecond
+	entry.SemaphoreWait = 0
+	entry.SetUpstream("app.default.svc.cluster.local", http.StatusOK, 11*time.Millisecond)
+
+	buf.Reset()
+	writeCustomLog(buf, req, *req.URL, ts, http.StatusOK, 100, "example.org")
+	log = buf.String()
+
+	expected = "192.168.100.5 - - [26/May/1983:03:30:45 +0200] \"GET / HTTP/1.1\" 200 100 example.org example.com 10.0.0.0 127.0.0.1, 127.0.0.1 \"http://example.com\" " +
+		"\"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_8_2) " +
+		"AppleWebKit/537.33 (KHTML, like Gecko) Chrome/27.0.1430.0 Safari/537.33\" 12.000 11.500 0.000 11.000 abc123 -\n"
 	if log != expected {
 		t.Fatalf("wrong log, got %q want %q", log, expected)
 	}
 }
+
+func TestCustomLoggingHandlerVariant(t *testing.T) {
+	buf := new(bytes.Buffer)
+	handler := CustomLoggingHandler(buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		GetEntry(req).SetVariant("story-v2")
+		w.Write([]byte(ok))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://example.com"))
+
+	if log := buf.String(); !strings.HasSuffix(log, " - - - story-v2\n") {
+		t.Fatalf("expected the log line to end with the variant, got %q", log)
+	}
+}
+
+func TestWriteJSONLog(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		panic(err)
+	}
+	ts := time.Date(1983, 05, 26, 3, 30, 45, 0, loc)
+
+	req := newRequest("GET", "http://example.com/tabby?a=1")
+	req.RemoteAddr = net.JoinHostPort("192.168.100.5", "65000")
+	req.Header.Set("Referer", "http://example.com")
+	req.Header.Set("X-Forwarded-For", "127.0.0.1, 127.0.0.1")
+	req.Header.Set("X-Request-ID", "abc123")
+	req.Header.Set("User-Agent", "Mozilla/5.0 \"quoted\"")
+	url := *req.URL
+
+	// Route the request as the router would.
+	req, entry := withEntry(req)
+	entry.SetRoute("service", "/")
+	req.URL.Scheme = "http"
+	req.URL.Host = "cats.default.svc.cluster.local"
+
+	entry.TTFB = 1200 * time.Microsecond
+	entry.SetSemaphoreWait(100 * time.Microsecond)
+	entry.SetUpstream("app.default.svc.cluster.local", http.StatusOK, time.Millisecond)
+
+	buf := new(bytes.Buffer)
+	writeJSONLog(buf, JSONFields, req, url, ts, 1500*time.Microsecond, http.StatusOK, 100, "example.org")
+	log := buf.String()
+
+	expected := `{"timestamp":"1983-05-26T03:30:45+02:00","duration_ms":1.500,"ttfb_ms":1.200,"semaphore_wait_ms":0.100,"upstream_ms":1.000,"status":200,"bytes":100,` +
+		`"method":"GET","host":"example.com","path":"/tabby","query":"a=1","original_host":"example.org",` +
+		`"upstream_url":"http://cats.default.svc.cluster.local/tabby?a=1","route_kind":"service","prefix":"/","variant":"",` +
+		`"client_ip":"192.168.100.5","x_forwarded_for":"127.0.0.1, 127.0.0.1","referer":"http://example.com",` +
+		`"user_agent":"Mozilla/5.0 \"quoted\"","request_id":"abc123"}` + "\n"
+	if log != expected {
+		t.Fatalf("wrong log, got %q want %q", log, expected)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("log line isn't valid JSON: %s", err)
+	}
+
+	// A subset of fields, given out of order, is written in the standard order.
+	fields, err := ParseJSONFields("status, method")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	writeJSONLog(buf, fields, req, url, ts, time.Millisecond, http.StatusNotFound, 0, "example.org")
+	if log := buf.String(); log != `{"status":404,"method":"GET"}`+"\n" {
+		t.Fatalf("wrong log, got %q", log)
+	}
+
+	if _, err := ParseJSONFields("status,nope"); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	buf := new(bytes.Buffer)
+	var recorded *Entry
+	recorder := func(req *http.Request, entry *Entry) {
+		recorded = entry
+	}
+
+	handler, err := NewHandler(buf, Options{Format: FormatJSON, Fields: []string{"status", "route_kind", "upstream_ms"}, Recorder: recorder}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		GetEntry(req).SetRoute("redirect", "/")
+		time.Sleep(time.Millisecond)
+		http.Redirect(w, req, "https://example.org/", http.StatusFound)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://example.com"))
+	if log := buf.String(); log != `{"status":302,"route_kind":"redirect","upstream_ms":null}`+"\n" {
+		t.Fatalf("wrong log, got %q", log)
+	}
+
+	if recorded == nil {
+		t.Fatal("expected the recorder to be called")
+	}
+	if recorded.Status != http.StatusFound || recorded.Size == 0 {
+		t.Errorf("expected the entry to record a 302 response with a body, got %d and %d", recorded.Status, recorded.Size)
+	}
+	if recorded.TTFB < time.Millisecond || recorded.Duration < recorded.TTFB {
+		t.Errorf("expected a TTFB of at least 1ms and no more than the duration, got %s and %s", recorded.TTFB, recorded.Duration)
+	}
+
+	if _, err := NewHandler(buf, Options{Format: "apache"}, okHandler); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(filename, []byte(`{
+		"*": {
+			"skip_paths": ["/status"],
+			"skip_user_agents": ["kube-probe"],
+			"redact_query": ["token"],
+			"redact_headers": ["X-Forwarded-For"]
+		},
+		"static.example.com": {"sample_2xx_percent": 0}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := LoadRules(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	status := http.StatusOK
+	handler, err := NewHandler(buf, Options{Format: FormatCombined, Rules: rules}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := newRequest("GET", "http://example.com/")
+	probe.Header.Set("User-Agent", "kube-probe/1.5")
+
+	tests := []struct {
+		req    *http.Request
+		status int
+		logged bool
+	}{
+		{newRequest("GET", "http://example.com/"), http.StatusOK, true},
+		{newRequest("GET", "http://example.com/status"), http.StatusOK, false},
+		{newRequest("GET", "http://example.com/status"), http.StatusServiceUnavailable, true},
+		{probe, http.StatusOK, false},
+		{newRequest("GET", "http://static.example.com/cat.jpg"), http.StatusOK, false},
+		{newRequest("GET", "http://static.example.com/cat.jpg"), http.StatusNotFound, true},
+	}
+
+	for _, test := range tests {
+		buf.Reset()
+		status = test.status
+		handler.ServeHTTP(httptest.NewRecorder(), test.req)
+		if logged := buf.Len() > 0; logged != test.logged {
+			t.Errorf("%s %d: expected logged to be %t, got %q", test.req.URL, test.status, test.logged, buf.String())
+		}
+	}
+
+	req := newRequest("GET", "http://example.com/tabby?a=1&token=secret&b=2")
+	req.RequestURI = "/tabby?a=1&token=secret&b=2"
+	req.Header.Set("Referer", "http://example.com/?token=secret")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	redacted, url := rules.For("example.com").Redact(req, *req.URL)
+	if url.RawQuery != "a=1&token=REDACTED&b=2" || redacted.RequestURI != "/tabby?a=1&token=REDACTED&b=2" {
+		t.Errorf("expected the token to be redacted, got %q and %q", url.RawQuery, redacted.RequestURI)
+	}
+	if redacted.Referer() != "http://example.com/?token=REDACTED" {
+		t.Errorf("expected the referer token to be redacted, got %q", redacted.Referer())
+	}
+	if redacted.Header.Get("X-Forwarded-For") != Redacted {
+		t.Errorf("expected X-Forwarded-For to be redacted, got %q", redacted.Header.Get("X-Forwarded-For"))
+	}
+	if redacted.URL.RawQuery != "a=1&token=REDACTED&b=2" {
+		t.Errorf("expected the upstream URL token to be redacted, got %q", redacted.URL.RawQuery)
+	}
+	if req.URL.RawQuery != "a=1&token=secret&b=2" || req.Header.Get("X-Forwarded-For") != "10.0.0.1" {
+		t.Error("expected the original request to be left alone")
+	}
+
+	// No field of a JSON line may give the secrets away, including the
+	// upstream URL the request was rewritten to.
+	buf.Reset()
+	status = http.StatusOK
+	jsonHandler, err := NewHandler(buf, Options{Format: FormatJSON, Fields: JSONFields, Rules: rules}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme = "http"
+		req.URL.Host = "tabby.default.svc.cluster.local"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if len(line) != len(JSONFields) {
+		t.Errorf("expected %d fields, got %d", len(JSONFields), len(line))
+	}
+	for field, value := range line {
+		if s, ok := value.(string); ok && (strings.Contains(s, "secret") || strings.Contains(s, "10.0.0.1")) {
+			t.Errorf("expected %s to be redacted, got %q", field, s)
+		}
+	}
+	if upstream := line["upstream_url"]; upstream != "http://tabby.default.svc.cluster.local/tabby?a=1&token=REDACTED&b=2" {
+		t.Errorf("expected the upstream URL to be logged redacted, got %q", upstream)
+	}
+}
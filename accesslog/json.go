@@ -0,0 +1,182 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/forwarded"
+)
+
+// JSONFields lists every field a JSON access log line can have, in the order
+// they're written.
+var JSONFields = []string{
+	"timestamp",
+	"duration_ms",
+	"ttfb_ms",
+	"semaphore_wait_ms",
+	"upstream_ms",
+	"status",
+	"bytes",
+	"method",
+	"host",
+	"path",
+	"query",
+	"original_host",
+	"upstream_url",
+	"route_kind",
+	"prefix",
+	"variant",
+	"client_ip",
+	"x_forwarded_for",
+	"referer",
+	"user_agent",
+	"request_id",
+}
+
+// ParseJSONFields parses a comma separated list of JSON access log fields,
+// keeping them in the order of JSONFields. An empty list selects every field.
+func ParseJSONFields(raw string) ([]string, error) {
+	if raw == "" {
+		return JSONFields, nil
+	}
+
+	selected := make(map[string]bool)
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		known := false
+		for _, f := range JSONFields {
+			if f == field {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown access log field %q", field)
+		}
+		selected[field] = true
+	}
+
+	var fields []string
+	for _, field := range JSONFields {
+		if selected[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// jsonLoggingHandler is the http.Handler implementation for JSONLoggingHandler.
+type jsonLoggingHandler struct {
+	writer  io.Writer
+	handler http.Handler
+	options Options
+}
+
+func (h jsonLoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	url := *req.URL
+	originalHost := req.Host
+	req, entry := serveLogged(h.handler, h.options.Recorder, w, req)
+	if req, url, ok := h.options.apply(req, url, originalHost, entry); ok {
+		writeJSONLog(h.writer, h.options.Fields, req, url, entry.Start, entry.Duration, entry.Status, entry.Size, originalHost)
+	}
+}
+
+// JSONLoggingHandler returns a http.Handler that wraps h and logs requests to
+// out as one JSON object per line, with the given fields.
+func JSONLoggingHandler(out io.Writer, fields []string, h http.Handler) http.Handler {
+	return jsonLoggingHandler{writer: out, handler: h, options: Options{Fields: fields}}
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	// Marshalling a string can't fail.
+	b, _ := json.Marshal(s)
+	return append(buf, b...)
+}
+
+// appendJSONMilliseconds appends a duration in milliseconds, or null if the
+// duration isn't known.
+func appendJSONMilliseconds(buf []byte, d time.Duration, known bool) []byte {
+	if !known {
+		return append(buf, "null"...)
+	}
+	return strconv.AppendFloat(buf, float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// writeJSONLog writes a log entry for req to w as a JSON object.
+// url is the request URL as received, before any rewriting, ts is the time the
+// request was received and duration is how long it took to handle.
+func writeJSONLog(w io.Writer, fields []string, req *http.Request, url url.URL, ts time.Time, duration time.Duration, status, size int, originalHost string) {
+	entry := GetEntry(req)
+	if entry == nil {
+		entry = &Entry{}
+	}
+
+	buf := make([]byte, 0, 512)
+	buf = append(buf, '{')
+	for i, field := range fields {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, field)
+		buf = append(buf, ':')
+
+		switch field {
+		case "timestamp":
+			buf = appendJSONString(buf, ts.Format(time.RFC3339Nano))
+		case "duration_ms":
+			buf = appendJSONMilliseconds(buf, duration, true)
+		case "ttfb_ms":
+			buf = appendJSONMilliseconds(buf, entry.TTFB, entry.TTFB > 0)
+		case "semaphore_wait_ms":
+			buf = appendJSONMilliseconds(buf, entry.SemaphoreWait, entry.UpstreamStatus != 0)
+		case "upstream_ms":
+			buf = appendJSONMilliseconds(buf, entry.UpstreamDuration, entry.UpstreamStatus != 0)
+		case "status":
+			buf = strconv.AppendInt(buf, int64(status), 10)
+		case "bytes":
+			buf = strconv.AppendInt(buf, int64(size), 10)
+		case "method":
+			buf = appendJSONString(buf, req.Method)
+		case "host":
+			buf = appendJSONString(buf, req.Host)
+		case "path":
+			buf = appendJSONString(buf, url.Path)
+		case "query":
+			buf = appendJSONString(buf, url.RawQuery)
+		case "original_host":
+			buf = appendJSONString(buf, originalHost)
+		case "upstream_url":
+			upstream := ""
+			if req.URL.Host != "" {
+				upstream = req.URL.String()
+			}
+			buf = appendJSONString(buf, upstream)
+		case "route_kind":
+			buf = appendJSONString(buf, entry.RouteKind)
+		case "prefix":
+			buf = appendJSONString(buf, entry.Prefix)
+		case "variant":
+			buf = appendJSONString(buf, entry.Variant)
+		case "client_ip":
+			buf = appendJSONString(buf, forwarded.ClientIP(req))
+		case "x_forwarded_for":
+			buf = appendJSONString(buf, req.Header.Get("X-Forwarded-For"))
+		case "referer":
+			buf = appendJSONString(buf, req.Referer())
+		case "user_agent":
+			buf = appendJSONString(buf, req.UserAgent())
+		case "request_id":
+			buf = appendJSONString(buf, req.Header.Get("X-Request-ID"))
+		default:
+			buf = append(buf, "null"...)
+		}
+	}
+	buf = append(buf, '}', '\n')
+	w.Write(buf)
+}
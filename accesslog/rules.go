@@ -0,0 +1,161 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces redacted values in the access log.
+const Redacted = "REDACTED"
+
+// Rules decide which requests are written to the access log, and what is
+// redacted from them first. Error responses (with a status of 400 or above)
+// are always written.
+type Rules struct {
+	// Sample2xx is the percentage of 2xx responses to write. All of them are
+	// written if it isn't set.
+	Sample2xx *float64 `json:"sample_2xx_percent,omitempty"`
+
+	// SkipPaths are path prefixes, and SkipUserAgents user agent substrings,
+	// of requests not to write.
+	SkipPaths      []string `json:"skip_paths,omitempty"`
+	SkipUserAgents []string `json:"skip_user_agents,omitempty"`
+
+	// RedactQuery and RedactHeaders name query parameters (including those
+	// in the referer and upstream URLs) and headers whose values are replaced
+	// before writing.
+	RedactQuery   []string `json:"redact_query,omitempty"`
+	RedactHeaders []string `json:"redact_headers,omitempty"`
+}
+
+// RuleSet holds the rules for each host, with those for "*" applying to any
+// host without rules of its own.
+type RuleSet map[string]*Rules
+
+// LoadRules reads a rule set from a JSON file.
+func LoadRules(filename string) (RuleSet, error) {
+	rulesJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules RuleSet
+	if err := json.Unmarshal(rulesJSON, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	for host, r := range rules {
+		if r.Sample2xx != nil && (*r.Sample2xx < 0 || *r.Sample2xx > 100) {
+			return nil, fmt.Errorf("%s: %s: sample_2xx_percent isn't between 0 and 100", filename, host)
+		}
+	}
+	return rules, nil
+}
+
+// For gets the rules for a host, or nil if there are none.
+func (rs RuleSet) For(host string) *Rules {
+	if r, ok := rs[host]; ok {
+		return r
+	}
+	return rs["*"]
+}
+
+// Keep decides whether a request with the given response status is written.
+func (r *Rules) Keep(req *http.Request, path string, status int) bool {
+	if r == nil || status >= 400 {
+		return true
+	}
+
+	for _, prefix := range r.SkipPaths {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+
+	if userAgent := req.UserAgent(); userAgent != "" {
+		for _, skip := range r.SkipUserAgents {
+			if strings.Contains(userAgent, skip) {
+				return false
+			}
+		}
+	}
+
+	if r.Sample2xx != nil && status >= 200 && status < 300 {
+		return rand.Float64()*100 < *r.Sample2xx
+	}
+	return true
+}
+
+// Redact returns copies of a request and its original URL with values
+// redacted according to the rules. The request is only copied as far as
+// needed to write it to the access log.
+func (r *Rules) Redact(req *http.Request, u url.URL) (*http.Request, url.URL) {
+	if r == nil || (len(r.RedactQuery) == 0 && len(r.RedactHeaders) == 0) {
+		return req, u
+	}
+
+	redacted := new(http.Request)
+	*redacted = *req
+	redacted.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		redacted.Header[key] = values
+	}
+
+	if len(r.RedactQuery) > 0 {
+		u.RawQuery = redactQuery(u.RawQuery, r.RedactQuery)
+		if req.URL != nil {
+			upstream := *req.URL
+			upstream.RawQuery = redactQuery(upstream.RawQuery, r.RedactQuery)
+			redacted.URL = &upstream
+		}
+		if i := strings.IndexByte(redacted.RequestURI, '?'); i >= 0 {
+			redacted.RequestURI = redacted.RequestURI[:i+1] + redactQuery(redacted.RequestURI[i+1:], r.RedactQuery)
+		}
+		if referer, err := url.Parse(redacted.Referer()); err == nil && referer.RawQuery != "" {
+			referer.RawQuery = redactQuery(referer.RawQuery, r.RedactQuery)
+			redacted.Header["Referer"] = []string{referer.String()}
+		}
+	}
+
+	for _, name := range r.RedactHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := redacted.Header[name]; ok {
+			redactedValues := make([]string, len(values))
+			for i := range redactedValues {
+				redactedValues[i] = Redacted
+			}
+			redacted.Header[name] = redactedValues
+		}
+	}
+
+	return redacted, u
+}
+
+// redactQuery replaces the values of the named parameters in a raw query
+// string, leaving the rest of it as it was.
+func redactQuery(rawQuery string, names []string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		rawKey := param
+		if j := strings.IndexByte(param, '='); j >= 0 {
+			rawKey = param[:j]
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+
+		for _, name := range names {
+			if key == name {
+				params[i] = rawKey + "=" + Redacted
+				break
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9 || nacl
+// +build windows plan9 nacl
+
+package accesslog
+
+// ReopenOnSignal does nothing on platforms without SIGUSR1.
+func ReopenOnSignal(r Reopener) (stop func()) {
+	return func() {}
+}
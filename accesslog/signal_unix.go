@@ -0,0 +1,38 @@
+//go:build !windows && !plan9 && !nacl
+// +build !windows,!plan9,!nacl
+
+package accesslog
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ReopenOnSignal reopens a sink whenever the process receives SIGUSR1, until
+// the returned stop function is called.
+func ReopenOnSignal(r Reopener) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			if err := r.Reopen(); err != nil {
+				log.Errorln("Error reopening access log:", err)
+			} else {
+				log.Infoln("Reopened access log")
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(signals)
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// backupFormat is the timestamp suffix of rotated files.
+const backupFormat = "20060102T150405.000000000"
+
+// rotateRetry is how long to wait before trying to rotate again after a
+// rotation fails.
+const rotateRetry = time.Second
+
+// SinkConfig describes where access logs are written.
+type SinkConfig struct {
+	// Output is one of
+	//	stdout
+	//	file:///path/to/access.log
+	//	syslog:// (the local syslog daemon), syslog://host:port (over UDP)
+	//	or syslog+tcp://host:port
+	//	udp://host:port
+	//	unix:///path/to/socket or unixgram:///path/to/socket
+	Output string
+
+	// MaxSize, in bytes, and RotateInterval trigger file rotation, and
+	// MaxBackups is the number of rotated files to keep. Zero disables each.
+	MaxSize        int64
+	RotateInterval time.Duration
+	MaxBackups     int
+
+	// Tag is the syslog tag.
+	Tag string
+}
+
+// Reopener is a sink that can reopen its output, e.g. after it's been moved by
+// an external log rotation tool.
+type Reopener interface {
+	Reopen() error
+}
+
+// OpenSink opens the sink described by config.
+func OpenSink(config SinkConfig) (io.WriteCloser, error) {
+	if config.Output == "" || config.Output == "stdout" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	u, err := url.Parse(config.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return OpenRotatingFile(u.Path, config.MaxSize, config.RotateInterval, config.MaxBackups)
+	case "syslog", "syslog+tcp", "syslog+udp":
+		network := "udp"
+		if u.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		if u.Host == "" {
+			network = ""
+		}
+		return openSyslog(network, u.Host, config.Tag)
+	case "udp":
+		return &netSink{network: "udp", address: u.Host}, nil
+	case "unix", "unixgram":
+		return &netSink{network: u.Scheme, address: u.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown access log output %q", config.Output)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// netSink writes each line to a network connection, dialling it lazily and
+// again after an error.
+type netSink struct {
+	network, address string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *netSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, time.Second)
+		if err != nil {
+			return 0, err
+		}
+		s.conn = conn
+	}
+
+	n, err := s.conn.Write(p)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return n, err
+}
+
+func (s *netSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// RotatingFile is a file that is rotated once it reaches a size or age.
+// Rotated files are renamed with a timestamp suffix.
+type RotatingFile struct {
+	path           string
+	maxSize        int64
+	rotateInterval time.Duration
+	maxBackups     int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	retryAt  time.Time
+}
+
+// OpenRotatingFile opens a file for appending, to be rotated once it's larger
+// than maxSize bytes or older than rotateInterval, keeping maxBackups rotated
+// files. Zero disables each of these.
+func OpenRotatingFile(path string, maxSize int64, rotateInterval time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:           path,
+		maxSize:        maxSize,
+		rotateInterval: rotateInterval,
+		maxBackups:     maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.rotateInterval > 0 && time.Since(f.openedAt) >= f.rotateInterval)) &&
+		time.Now().After(f.retryAt) {
+		// A failed rotation leaves the current file open, so the line is
+		// still written to it.
+		if err := f.rotate(); err != nil {
+			log.Errorln("Error rotating access log:", err)
+			f.retryAt = time.Now().Add(rotateRetry)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one in its place. The
+// current file is only closed once the new one is open, so that lines are
+// never written to a closed file.
+func (f *RotatingFile) rotate() error {
+	backup := f.path + "." + time.Now().UTC().Format(backupFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+
+	if err := f.reopen(); err != nil {
+		return err
+	}
+
+	if f.maxBackups > 0 {
+		return f.prune()
+	}
+	return nil
+}
+
+// prune removes the oldest rotated files beyond maxBackups. Only files named
+// with the rotation's timestamp suffix are considered.
+func (f *RotatingFile) prune() error {
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, info := range infos {
+		suffix := strings.TrimPrefix(info.Name(), base+".")
+		if suffix == info.Name() || info.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupFormat, suffix); err == nil {
+			backups = append(backups, filepath.Join(dir, info.Name()))
+		}
+	}
+
+	// The timestamp suffixes sort chronologically.
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// reopen opens the path again and closes the old file. If the path can't be
+// opened, the old file is kept.
+func (f *RotatingFile) reopen() error {
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// Reopen opens the file's path again, e.g. after it's been moved. The old
+// file is kept if the path can't be opened.
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reopen()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
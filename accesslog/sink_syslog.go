@@ -0,0 +1,15 @@
+//go:build !windows && !plan9 && !nacl
+// +build !windows,!plan9,!nacl
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to a syslog daemon, or the local one if network is
+// empty. Lines are sent with the info priority of the local0 facility.
+func openSyslog(network, address, tag string) (io.WriteCloser, error) {
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
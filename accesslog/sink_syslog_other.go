@@ -0,0 +1,13 @@
+//go:build windows || plan9 || nacl
+// +build windows plan9 nacl
+
+package accesslog
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(network, address, tag string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog isn't supported on this platform")
+}
@@ -0,0 +1,184 @@
+package accesslog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingWriter holds up writes until it's released.
+type blockingWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriter(t *testing.T) {
+	for _, test := range []struct {
+		policy   DropPolicy
+		expected string
+		dropped  uint64
+	}{
+		// The first line is taken off the queue by the writer straight away,
+		// leaving room for two more.
+		{DropNewest, "a\nb\nc\n", 2},
+		{DropOldest, "a\nd\ne\n", 2},
+		{DropNone, "a\nb\nc\nd\ne\n", 0},
+	} {
+		w := &blockingWriter{release: make(chan struct{})}
+		var drops uint64
+		a := NewAsyncWriter(w, 2, test.policy, func() { drops++ })
+
+		a.Write([]byte("a\n"))
+		for len(a.lines) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		if test.policy == DropNone {
+			close(w.release)
+		}
+		for _, line := range []string{"b\n", "c\n", "d\n", "e\n"} {
+			a.Write([]byte(line))
+		}
+		if test.policy != DropNone {
+			close(w.release)
+		}
+		a.Close()
+
+		if got := w.buf.String(); got != test.expected {
+			t.Errorf("%s: wrote %q, expected %q", test.policy, got, test.expected)
+		}
+		if a.Dropped() != test.dropped || drops != test.dropped {
+			t.Errorf("%s: dropped %d (%d callbacks), expected %d", test.policy, a.Dropped(), drops, test.dropped)
+		}
+	}
+
+	// Lines written once it's closed are dropped rather than queued.
+	a := NewAsyncWriter(ioutil.Discard, 1, DropNone, nil)
+	a.Close()
+	a.Write([]byte("late\n"))
+	if a.Dropped() != 1 {
+		t.Errorf("expected a line written after closing to be dropped, got %d dropped", a.Dropped())
+	}
+
+	if _, err := ParseDropPolicy("sometimes"); err == nil {
+		t.Error("expected an error for an unknown drop policy")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "access.log")
+	unrelated := filename + ".old"
+	if err := ioutil.WriteFile(unrelated, []byte("keep me\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotatingFile(filename, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, _ := filepath.Glob(filename + ".2*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 rotated files, got %v", backups)
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("expected files that weren't rotated to be kept, got %s", err)
+	}
+	if b, _ := ioutil.ReadFile(filename); string(b) != "line 4\n" {
+		t.Errorf("expected the current file to hold the last line, got %q", b)
+	}
+
+	// Reopen picks up a file moved away by an external tool.
+	if err := os.Rename(filename, filename+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("line 5\n"))
+	f.Close()
+
+	if b, _ := ioutil.ReadFile(filename); string(b) != "line 5\n" {
+		t.Errorf("expected the reopened file to hold the next line, got %q", b)
+	}
+
+	// If the path can't be opened again, lines keep going to the old file.
+	filename = filepath.Join(dir, "other.log")
+	if f, err = OpenRotatingFile(filename, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("line 1\n"))
+	if err := os.Rename(filename, filename+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filename, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err == nil {
+		t.Error("expected an error reopening a directory")
+	}
+	if _, err := f.Write([]byte("line 2\n")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if b, _ := ioutil.ReadFile(filename + ".moved"); string(b) != "line 1\nline 2\n" {
+		t.Errorf("expected the old file to hold the next line, got %q", b)
+	}
+}
+
+func TestOpenSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := OpenSink(SinkConfig{Output: "udp://" + conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if _, err := sink.Write([]byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "line\n" {
+		t.Errorf("expected a datagram of the line, got %q", buf[:n])
+	}
+
+	if _, err := OpenSink(SinkConfig{Output: "carrier-pigeon://"}); err == nil {
+		t.Error("expected an error for an unknown output")
+	}
+}
@@ -1,37 +1,49 @@
+// Package datadog sends metrics to a DataDog agent over statsd.
 package datadog
 
 import (
-	"os"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/DataDog/datadog-go/statsd"
 )
 
-var (
-	dataDogHostPort = os.Getenv("DD_AGENT_SERVICE_HOST_PORT")
-	client, err     = statsd.New(dataDogHostPort) //in host:port format
-)
+// Client sends metrics to a DataDog agent, implementing metrics.Metrics.
+// Errors sending metrics are logged.
+type Client struct {
+	client *statsd.Client
+}
 
-func init() {
+// New connects to the agent at address, in host:port format. Every metric name
+// is prefixed with namespace.
+func New(address, namespace string) (*Client, error) {
+	client, err := statsd.New(address)
 	if err != nil {
-		log.Error("Couldn't connect to statsd", dataDogHostPort, err)
-	} else {
-		log.Info("Connected to statsd", dataDogHostPort)
-		// prefix every metric with the app name
-		client.Namespace = "k8s_dns."
-		// send the pod hostname as a tag with every metric
-		client.Tags = append(client.Tags, os.Getenv("ENVIRONMENT"))
+		return nil, err
 	}
+	client.Namespace = namespace
+	return &Client{client: client}, nil
 }
 
-func Count(name string, value int64, tags []string, rate float64) {
-	//See init(). If connecting to DD-Agent failed, err is not nil
-	if (err != nil) {
-		return
-	}
-	countError := client.Count(name, value, tags, rate)
-	if countError != nil {
-		log.Error("Error sending metrics to DataDog:", countError)
+func logError(err error) {
+	if err != nil {
+		log.Error("Error sending metrics to DataDog:", err)
 	}
 }
+
+func (c *Client) Count(name string, value int64, tags []string) {
+	logError(c.client.Count(name, value, tags, 1.0))
+}
+
+func (c *Client) Gauge(name string, value float64, tags []string) {
+	logError(c.client.Gauge(name, value, tags, 1.0))
+}
+
+func (c *Client) Histogram(name string, value float64, tags []string) {
+	logError(c.client.Histogram(name, value, tags, 1.0))
+}
+
+func (c *Client) Timing(name string, value time.Duration, tags []string) {
+	logError(c.client.Timing(name, value, tags, 1.0))
+}
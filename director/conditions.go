@@ -0,0 +1,84 @@
+package director
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Conditions restrict a route to some of the requests matching its prefix.
+// Every condition given must hold, and they're checked in the order of the
+// fields below. An empty header or query value only requires the header or
+// parameter to be present.
+type Conditions struct {
+	Methods []string          `json:"methods,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Cookies []string          `json:"cookies,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+}
+
+// Validate checks that the conditions can be met.
+func (c *Conditions) Validate() error {
+	if len(c.Methods) == 0 && len(c.Headers) == 0 && len(c.Cookies) == 0 && len(c.Query) == 0 {
+		return errors.New("conditions are empty")
+	}
+	for _, method := range c.Methods {
+		if method == "" {
+			return errors.New("empty method in conditions")
+		}
+	}
+	return nil
+}
+
+// Match reports whether a request meets the conditions.
+func (c *Conditions) Match(req *http.Request) bool {
+	if len(c.Methods) > 0 && !matchMethod(c.Methods, req.Method) {
+		return false
+	}
+
+	for name, value := range c.Headers {
+		if !matchValues(req.Header[http.CanonicalHeaderKey(name)], value) {
+			return false
+		}
+	}
+
+	for _, name := range c.Cookies {
+		if _, err := req.Cookie(name); err != nil {
+			return false
+		}
+	}
+
+	if len(c.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range c.Query {
+			if !matchValues(query[name], value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func matchMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchValues reports whether any of values equals value, or if value is
+// empty, whether there are any values at all.
+func matchValues(values []string, value string) bool {
+	if value == "" {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,9 @@ package director
 
 import (
 	"errors"
+	"net/http"
 
-	"github.com/newsdev/kubernetes-dns-reverse-proxy/datadog"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
 )
 
 var (
@@ -12,15 +13,20 @@ var (
 
 type Director struct {
 	domains map[string]*Matcher
+	metrics metrics.Metrics
 }
 
-func NewDirector() *Director {
+// NewDirector creates a director with no routes, which counts requests it
+// can't route in m. m may be nil.
+func NewDirector(m metrics.Metrics) *Director {
 	return &Director{
 		domains: make(map[string]*Matcher),
+		metrics: metrics.OrNop(m),
 	}
 }
 
-func (d *Director) SetService(domain, prefix, service string) {
+// SetRoutes sets the routes for a domain and path prefix.
+func (d *Director) SetRoutes(domain, prefix string, routes ...*Route) {
 
 	matcher, ok := d.domains[domain]
 	if !ok {
@@ -28,16 +34,22 @@ func (d *Director) SetService(domain, prefix, service string) {
 		d.domains[domain] = matcher
 	}
 
-	matcher.SetPrefix(prefix, service)
+	matcher.SetPrefix(prefix, routes...)
 }
 
-func (d *Director) Service(domain, path string) (string, string, error) {
+// Route finds the route for a request by its host and path, along with the
+// matched path prefix.
+func (d *Director) Route(req *http.Request) (*Route, string, error) {
 
-	matcher, ok := d.domains[domain]
+	matcher, ok := d.domains[req.Host]
 	if !ok {
-		datadog.Count("no_matching_service_error", 1, nil, 1.0)
-		return "", "", NoMatchingServiceError
+		d.metrics.Count("no_matching_service_error", 1, nil)
+		return nil, "", NoMatchingServiceError
 	}
 
-	return matcher.Match(path)
+	route, prefix, err := matcher.Match(req)
+	if err == noMatchingPrefixError {
+		d.metrics.Count("no_matching_prefix_error", 1, nil)
+	}
+	return route, prefix, err
 }
@@ -0,0 +1,138 @@
+package director
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/forwarded"
+)
+
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Headers describes how a route changes the headers of the requests it
+// proxies and of the responses it returns.
+type Headers struct {
+	Request  *HeaderRules `json:"request,omitempty"`
+	Response *HeaderRules `json:"response,omitempty"`
+}
+
+// Validate checks both sets of rules.
+func (h *Headers) Validate() error {
+	if err := h.Request.Validate(); err != nil {
+		return fmt.Errorf("request headers: %s", err)
+	}
+	if err := h.Response.Validate(); err != nil {
+		return fmt.Errorf("response headers: %s", err)
+	}
+	return nil
+}
+
+// HeaderRules removes, sets and adds headers, in that order. Values may
+// contain the placeholders described by placeholders, which are expanded for
+// every request.
+type HeaderRules struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// Validate checks the header names and value templates.
+func (h *HeaderRules) Validate() error {
+	if h == nil {
+		return nil
+	}
+
+	for _, name := range h.Remove {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+
+	for _, values := range []map[string]string{h.Set, h.Add} {
+		for name, value := range values {
+			if !validHeaderName(name) {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("%s: value contains a line break", name)
+			}
+			if _, err := expand(value, placeholders{}); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Expand gets a copy of the rules with the values expanded for a request to a
+// route with prefix.
+func (h *HeaderRules) Expand(req *http.Request, prefix string) *HeaderRules {
+	if h == nil {
+		return nil
+	}
+
+	p := placeholders{
+		host:     req.Host,
+		path:     req.URL.Path,
+		prefix:   prefix,
+		query:    req.URL.RawQuery,
+		clientIP: forwarded.ClientIP(req),
+	}
+
+	return &HeaderRules{
+		Set:    expandValues(h.Set, p),
+		Add:    expandValues(h.Add, p),
+		Remove: h.Remove,
+	}
+}
+
+// expandValues expands each value. Values are checked by Validate, so they
+// always expand, and line breaks from the request are replaced so they can't
+// start a new header.
+func expandValues(values map[string]string, p placeholders) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	expanded := make(map[string]string, len(values))
+	for name, value := range values {
+		value, _ = expand(value, p)
+		expanded[name] = lineBreaks.Replace(value)
+	}
+	return expanded
+}
+
+// Apply changes header following the rules, which should have been expanded
+// for the request.
+func (h *HeaderRules) Apply(header http.Header) {
+	if h == nil {
+		return
+	}
+
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		header.Add(name, value)
+	}
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package director
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	var route Route
+	if err := json.Unmarshal([]byte(`{
+		"service": "cats",
+		"headers": {
+			"request": {
+				"set": {"X-Client": "{client_ip}", "X-Section": "{path.0}"},
+				"add": {"X-Via": "{host}{prefix}"},
+				"remove": ["Cookie"]
+			},
+			"response": {
+				"set": {"Strict-Transport-Security": "max-age=31536000"},
+				"remove": ["Server"]
+			}
+		}
+	}`), &route); err != nil {
+		t.Fatal(err)
+	}
+	if err := route.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := newRequest("GET", "http://www.cats.com/tabby/1?a=b")
+	req.RemoteAddr = "192.0.2.1:41000"
+	req.Header.Set("Cookie", "a=b")
+	req.Header.Set("X-Via", "lb")
+	route.Headers.Request.Expand(req, "/tabby").Apply(req.Header)
+
+	for name, expected := range map[string][]string{
+		"Cookie":    nil,
+		"X-Client":  {"192.0.2.1"},
+		"X-Section": {"tabby"},
+		"X-Via":     {"lb", "www.cats.com/tabby"},
+	} {
+		if got := req.Header[name]; len(got) != len(expected) || (len(got) > 0 && got[len(got)-1] != expected[len(expected)-1]) {
+			t.Errorf("expected %s %q, got %q", name, expected, got)
+		}
+	}
+
+	header := http.Header{"Server": {"nginx"}}
+	route.Headers.Response.Expand(req, "/tabby").Apply(header)
+	if header.Get("Server") != "" || header.Get("Strict-Transport-Security") != "max-age=31536000" {
+		t.Errorf("unexpected response headers %v", header)
+	}
+
+	// Routes without rules leave headers alone.
+	var rules *HeaderRules
+	rules.Expand(req, "/").Apply(header)
+
+	for _, invalid := range []*HeaderRules{
+		{Set: map[string]string{"X Bad": "1"}},
+		{Add: map[string]string{"X-Bad": "{nope}"}},
+		{Set: map[string]string{"X-Bad": "a\r\nb"}},
+		{Remove: []string{""}},
+	} {
+		if err := (&Headers{Response: invalid}).Validate(); err == nil {
+			t.Errorf("expected an error for %+v", invalid)
+		}
+	}
+}
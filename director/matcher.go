@@ -2,67 +2,136 @@ package director
 
 import (
 	"errors"
-	"strings"
-
-	"github.com/newsdev/kubernetes-dns-reverse-proxy/datadog"
+	"net/http"
 )
 
 var (
 	noMatchingPrefixError = errors.New("no matching prefix found")
 )
 
-type Matcher struct {
-	prefixesList []string
-	prefixes     map[string]string
+// node is a node in a compressed radix tree of path prefixes. Each edge is
+// labelled with a string, and the prefix of a node is the concatenation of the
+// labels on the way to it from the root.
+type node struct {
+	label    string
+	prefix   string
+	routes   Routes
+	children []*node
 }
 
-func NewMatcher() *Matcher {
-	return &Matcher{
-		prefixes: make(map[string]string),
+// child finds the child whose label begins with the byte c.
+func (n *node) child(c byte) *node {
+	for _, child := range n.children {
+		if child.label[0] == c {
+			return child
+		}
 	}
+	return nil
 }
 
-func (m *Matcher) SetPrefix(prefix, value string) {
+// Matcher finds the longest path prefix matching a path.
+type Matcher struct {
+	root node
+}
 
-	// We only want to add this value to the list if we haven't seen it before.
-	if _, ok := m.prefixes[prefix]; !ok {
+func NewMatcher() *Matcher {
+	return &Matcher{}
+}
 
-		// Save a temporary reference to the list and create a new list that has
-		// room for another element.
-		tmpPrefixesList := m.prefixesList
-		m.prefixesList = make([]string, len(m.prefixesList)+1)
+// commonPrefixLength gets the length of the longest common prefix of a and b.
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for ; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+	}
+	return i
+}
 
-		// Find the correct index for the prefix, copying all values up to that point.
-		i := 0
-		for ; i < len(tmpPrefixesList) && len(tmpPrefixesList[i]) > len(prefix); i++ {
-			m.prefixesList[i] = tmpPrefixesList[i]
+// SetPrefix sets the routes for a path prefix, replacing any it already had.
+func (m *Matcher) SetPrefix(prefix string, routes ...*Route) {
+
+	n := &m.root
+	rest := prefix
+	for rest != "" {
+		child := n.child(rest[0])
+
+		// No edge shares a first byte with the rest of the prefix, so it gets a
+		// new leaf of its own.
+		if child == nil {
+			n.children = append(n.children, &node{
+				label:  rest,
+				prefix: prefix,
+				routes: routes,
+			})
+			return
 		}
 
-		// Set the prefix.
-		m.prefixesList[i] = prefix
+		// The edge is entirely shared, so carry on down the tree.
+		common := commonPrefixLength(rest, child.label)
+		if common == len(child.label) {
+			n = child
+			rest = rest[common:]
+			continue
+		}
 
-		// Copy the remaining values from the old list.
-		for ; i < len(tmpPrefixesList); i++ {
-			m.prefixesList[i+1] = tmpPrefixesList[i]
+		// The edge is partially shared, so split it with an intermediate node.
+		split := &node{
+			label:    child.label[:common],
+			prefix:   prefix[:len(prefix)-len(rest)+common],
+			children: []*node{child},
 		}
+		child.label = child.label[common:]
+		for i := range n.children {
+			if n.children[i] == child {
+				n.children[i] = split
+			}
+		}
+
+		n = split
+		rest = rest[common:]
 	}
 
-	m.prefixes[prefix] = value
+	n.prefix = prefix
+	n.routes = routes
 }
 
-func (m *Matcher) Match(path string) (string, string, error) {
+// Match finds the route for a request with the longest path prefix matching
+// its path. If none of the routes for that prefix match the request, shorter
+// prefixes are tried in turn.
+func (m *Matcher) Match(req *http.Request) (*Route, string, error) {
 
 	// TODO:
 	// match with regex
 
-	// The list of path prefixes is in reverse order by string length. We want
-	// to return the first (most specific) match we come accross.
-	for _, prefix := range m.prefixesList {
-		if strings.HasPrefix(path, prefix) {
-			return m.prefixes[prefix], prefix, nil
+	// Walk down the tree as far as the path allows, collecting the prefixes
+	// with routes along the way, from least to most specific.
+	var candidatesArray [8]*node
+	candidates := candidatesArray[:0]
+
+	n := &m.root
+	rest := req.URL.Path
+	for {
+		if len(n.routes) > 0 {
+			candidates = append(candidates, n)
+		}
+
+		if rest == "" {
+			break
+		}
+
+		child := n.child(rest[0])
+		if child == nil || len(rest) < len(child.label) || rest[:len(child.label)] != child.label {
+			break
+		}
+
+		n = child
+		rest = rest[len(child.label):]
+	}
+
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if route := candidates[i].routes.Match(req); route != nil {
+			return route, candidates[i].prefix, nil
 		}
 	}
 
-	datadog.Count("no_matching_prefix_error", 1, nil, 1.0)
-	return "", "", noMatchingPrefixError
+	return nil, "", noMatchingPrefixError
 }
@@ -1,9 +1,255 @@
 package director
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"testing"
 )
 
+func newRequest(method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
 func TestMatcher(t *testing.T) {
+	matcher := NewMatcher()
+	for _, prefix := range []string{
+		"/",
+		"/projects/app1",
+		"/projects/app2",
+		"/projects/app",
+		"/projects/application",
+		"/pro",
+		"/2012",
+	} {
+		matcher.SetPrefix(prefix, NewRoute(prefix))
+	}
+
+	// Setting a prefix again replaces its route.
+	matcher.SetPrefix("/2012", NewRoute("archive"))
+
+	tests := []struct {
+		path, prefix, service string
+	}{
+		{"/", "/", "/"},
+		{"/index.html", "/", "/"},
+		{"/projects/app1", "/projects/app1", "/projects/app1"},
+		{"/projects/app1/index.html", "/projects/app1", "/projects/app1"},
+		{"/projects/app2/", "/projects/app2", "/projects/app2"},
+		{"/projects/app3", "/projects/app", "/projects/app"},
+		{"/projects/applications", "/projects/application", "/projects/application"},
+		{"/projects/appl", "/projects/app", "/projects/app"},
+		{"/projects", "/pro", "/pro"},
+		{"/pr", "/", "/"},
+		{"/2012/06/01", "/2012", "archive"},
+	}
+
+	for _, test := range tests {
+		route, prefix, err := matcher.Match(newRequest("GET", "http://www.cats.com"+test.path))
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+			continue
+		}
+		if prefix != test.prefix || route.Service != test.service {
+			t.Errorf("%s: expected prefix %s and service %s, got %s and %s", test.path, test.prefix, test.service, prefix, route.Service)
+		}
+	}
+
+	matcher = NewMatcher()
+	matcher.SetPrefix("/projects", NewRoute("projects"))
+	if _, _, err := matcher.Match(newRequest("GET", "http://www.cats.com/pro")); err != noMatchingPrefixError {
+		t.Errorf("expected no match for a path shorter than every prefix, got %v", err)
+	}
+	if _, _, err := matcher.Match(newRequest("GET", "http://www.cats.com")); err != noMatchingPrefixError {
+		t.Errorf("expected no match for an empty path, got %v", err)
+	}
+}
+
+func TestMatcherConditions(t *testing.T) {
+	var routes map[string]Routes
+	if err := json.Unmarshal([]byte(`{
+		"/": "cats",
+		"/api": [
+			{"service": "cats-write", "when": {"methods": ["POST", "put"]}},
+			{"service": "cats-beta", "when": {"headers": {"X-Beta": "1"}}},
+			{"service": "cats-preview", "when": {"cookies": ["preview"], "query": {"draft": ""}}}
+		],
+		"/api/v2": {"service": "cats-v2", "when": {"query": {"version": "2"}}}
+	}`), &routes); err != nil {
+		t.Fatal(err)
+	}
 
+	matcher := NewMatcher()
+	for prefix, prefixRoutes := range routes {
+		if err := prefixRoutes.Validate(); err != nil {
+			t.Fatalf("%s: %s", prefix, err)
+		}
+		matcher.SetPrefix(prefix, prefixRoutes...)
+	}
+
+	beta := newRequest("GET", "http://www.cats.com/api/cats")
+	beta.Header.Set("X-Beta", "1")
+
+	betaPost := newRequest("POST", "http://www.cats.com/api/cats")
+	betaPost.Header.Set("X-Beta", "1")
+
+	preview := newRequest("GET", "http://www.cats.com/api/cats?draft")
+	preview.AddCookie(&http.Cookie{Name: "preview", Value: "yes"})
+
+	tests := []struct {
+		req             *http.Request
+		prefix, service string
+	}{
+		{newRequest("GET", "http://www.cats.com/api/cats"), "/", "cats"},
+		{newRequest("POST", "http://www.cats.com/api/cats"), "/api", "cats-write"},
+		{newRequest("PUT", "http://www.cats.com/api/cats"), "/api", "cats-write"},
+		{beta, "/api", "cats-beta"},
+		{betaPost, "/api", "cats-write"},
+		{preview, "/api", "cats-preview"},
+		{newRequest("GET", "http://www.cats.com/api/cats?draft"), "/", "cats"},
+		{newRequest("GET", "http://www.cats.com/api/v2/cats?version=2"), "/api/v2", "cats-v2"},
+		{newRequest("POST", "http://www.cats.com/api/v2/cats"), "/api", "cats-write"},
+	}
+
+	for _, test := range tests {
+		route, prefix, err := matcher.Match(test.req)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.req.Method, test.req.URL, err)
+			continue
+		}
+		if prefix != test.prefix || route.Service != test.service {
+			t.Errorf("%s %s: expected prefix %s and service %s, got %s and %s", test.req.Method, test.req.URL, test.prefix, test.service, prefix, route.Service)
+		}
+	}
+
+	var unreachable Routes
+	if err := json.Unmarshal([]byte(`["cats", {"service": "dogs", "when": {"methods": ["GET"]}}]`), &unreachable); err != nil {
+		t.Fatal(err)
+	}
+	if err := unreachable.Validate(); err == nil {
+		t.Error("expected routes after one without conditions to be unreachable")
+	}
 }
+
+func TestRoutePickTarget(t *testing.T) {
+	var route Route
+	if err := json.Unmarshal([]byte(`{
+		"targets": [{"service": "story-v1", "weight": 95}, {"service": "story-v2", "weight": 5}, {"service": "story-v3", "weight": 0}],
+		"sticky": {"header": "X-User-ID"}
+	}`), &route); err != nil {
+		t.Fatal(err)
+	}
+	if err := route.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		target, cookie := route.PickTarget(newRequest("GET", "http://www.cats.com/"))
+		if cookie != nil {
+			t.Fatal("expected no cookie for header stickiness")
+		}
+		counts[target.Service]++
+	}
+	if counts["story-v3"] != 0 {
+		t.Errorf("expected a target without weight never to be picked, got %d", counts["story-v3"])
+	}
+	if counts["story-v2"] < 300 || counts["story-v2"] > 700 {
+		t.Errorf("expected about 500 requests for story-v2, got %d", counts["story-v2"])
+	}
+
+	// The same header value always picks the same target.
+	req := newRequest("GET", "http://www.cats.com/")
+	req.Header.Set("X-User-ID", "12345")
+	first, _ := route.PickTarget(req)
+	for i := 0; i < 100; i++ {
+		if target, _ := route.PickTarget(req); target != first {
+			t.Fatalf("expected sticky header to pick %s, got %s", first.Service, target.Service)
+		}
+	}
+
+	route.Sticky = &Sticky{Cookie: "canary"}
+	target, cookie := route.PickTarget(newRequest("GET", "http://www.cats.com/"))
+	if cookie == nil || cookie.Name != "canary" || cookie.Value != target.Service {
+		t.Fatalf("expected a canary cookie naming %s, got %v", target.Service, cookie)
+	}
+
+	req = newRequest("GET", "http://www.cats.com/")
+	req.AddCookie(&http.Cookie{Name: "canary", Value: "story-v2"})
+	for i := 0; i < 100; i++ {
+		if target, cookie := route.PickTarget(req); target.Service != "story-v2" || cookie != nil {
+			t.Fatalf("expected sticky cookie to pick story-v2 without a new cookie, got %s and %v", target.Service, cookie)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"targets": [{"service": "story-v1", "weight": 0}]}`,
+		`{"targets": [{"service": "/story", "weight": 1}]}`,
+		`{"targets": [{"service": "story-v1", "weight": 1}], "service": "story"}`,
+		`{"targets": [{"service": "story-v1", "weight": 1}], "sticky": {}}`,
+		`{"service": "story", "sticky": {"cookie": "canary"}}`,
+	} {
+		var route Route
+		if err := json.Unmarshal([]byte(invalid), &route); err != nil {
+			t.Fatal(err)
+		}
+		if err := route.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", invalid)
+		}
+	}
+}
+
+func benchmarkPrefixes(n int) []string {
+	prefixes := make([]string, n)
+	for i := range prefixes {
+		prefixes[i] = fmt.Sprintf("/projects/%d/app-%d", i%100, i)
+	}
+	return prefixes
+}
+
+func benchmarkMatcherLoad(b *testing.B, n int) {
+	prefixes := benchmarkPrefixes(n)
+	route := NewRoute("service")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher := NewMatcher()
+		for _, prefix := range prefixes {
+			matcher.SetPrefix(prefix, route)
+		}
+	}
+}
+
+func benchmarkMatcherMatch(b *testing.B, n int) {
+	prefixes := benchmarkPrefixes(n)
+	matcher := NewMatcher()
+	matcher.SetPrefix("/", NewRoute("service"))
+	for _, prefix := range prefixes {
+		matcher.SetPrefix(prefix, NewRoute("service"))
+	}
+
+	requests := make([]*http.Request, len(prefixes))
+	for i, prefix := range prefixes {
+		requests[i] = newRequest("GET", "http://www.cats.com"+prefix+"/2012/06/01/index.html")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := matcher.Match(requests[i%len(requests)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatcherLoad10(b *testing.B)    { benchmarkMatcherLoad(b, 10) }
+func BenchmarkMatcherLoad1k(b *testing.B)    { benchmarkMatcherLoad(b, 1000) }
+func BenchmarkMatcherLoad100k(b *testing.B)  { benchmarkMatcherLoad(b, 100000) }
+func BenchmarkMatcherMatch10(b *testing.B)   { benchmarkMatcherMatch(b, 10) }
+func BenchmarkMatcherMatch1k(b *testing.B)   { benchmarkMatcherMatch(b, 1000) }
+func BenchmarkMatcherMatch100k(b *testing.B) { benchmarkMatcherMatch(b, 100000) }
@@ -0,0 +1,34 @@
+package director
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Mirror describes a service that is sent a sample of a route's requests as
+// shadow traffic, whose responses are discarded.
+type Mirror struct {
+	Service string  `json:"service"`
+	Percent float64 `json:"percent"`
+}
+
+// Validate checks the mirror's service and sampling percentage.
+func (m *Mirror) Validate() error {
+	if m.Service == "" {
+		return errors.New("mirror service is empty")
+	}
+	if strings.HasPrefix(m.Service, "/") || strings.HasPrefix(m.Service, ">") {
+		return fmt.Errorf("mirror %s isn't a service", m.Service)
+	}
+	if m.Percent <= 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror percent %g isn't between 0 and 100", m.Percent)
+	}
+	return nil
+}
+
+// Sample reports whether a request should be mirrored.
+func (m *Mirror) Sample() bool {
+	return m.Percent >= 100 || rand.Float64()*100 < m.Percent
+}
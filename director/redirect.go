@@ -0,0 +1,159 @@
+package director
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Path handling modes for redirects.
+const (
+	// RedirectPathPreserve appends the part of the request path following the
+	// matched prefix to the location. It's the default, unless the location
+	// uses {path}, {path.N} or {rest}.
+	RedirectPathPreserve = "preserve"
+
+	// RedirectPathFixed sends every request to the location as is.
+	RedirectPathFixed = "fixed"
+)
+
+// Query string handling modes for redirects.
+const (
+	// RedirectQueryReplace uses the request's query string in place of the
+	// location's, if the request has one.
+	RedirectQueryReplace = "replace"
+
+	// RedirectQueryMerge adds the request's query parameters to the location's.
+	RedirectQueryMerge = "merge"
+
+	// RedirectQueryDrop ignores the request's query string.
+	RedirectQueryDrop = "drop"
+)
+
+// Redirect describes a redirect route.
+//
+// Location may contain the placeholders described by placeholders, other
+// than {client_ip}, which are expanded for every request and escaped for the
+// part of the URL they're in.
+type Redirect struct {
+	Location string `json:"location"`
+	Status   int    `json:"status,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Query    string `json:"query,omitempty"`
+}
+
+// StatusCode gets the HTTP status code of the redirect, defaulting to 301.
+func (r *Redirect) StatusCode() int {
+	if r.Status == 0 {
+		return http.StatusMovedPermanently
+	}
+	return r.Status
+}
+
+// pathMode gets the path handling mode of the redirect. Locations that place
+// the request path themselves default to RedirectPathFixed, so that it isn't
+// appended twice.
+func (r *Redirect) pathMode() string {
+	if r.Path != "" {
+		return r.Path
+	}
+	if usesPath(r.Location) {
+		return RedirectPathFixed
+	}
+	return RedirectPathPreserve
+}
+
+// usesPath reports whether a location template places the request path, or
+// any segment of it.
+func usesPath(location string) bool {
+	uses := false
+	expandWith(location, func(name, literal string) (string, error) {
+		if name == "path" || name == "rest" || strings.HasPrefix(name, "path.") {
+			uses = true
+		}
+		return "", nil
+	})
+	return uses
+}
+
+// Validate checks the redirect options and location template.
+func (r *Redirect) Validate() error {
+	switch r.StatusCode() {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("unsupported redirect status %d", r.Status)
+	}
+
+	switch r.Path {
+	case "", RedirectPathPreserve, RedirectPathFixed:
+	default:
+		return fmt.Errorf("unknown redirect path mode %q", r.Path)
+	}
+
+	switch r.Query {
+	case "", RedirectQueryReplace, RedirectQueryMerge, RedirectQueryDrop:
+	default:
+		return fmt.Errorf("unknown redirect query mode %q", r.Query)
+	}
+
+	if r.Location == "" {
+		return fmt.Errorf("redirect location is empty")
+	}
+	if strings.Contains(r.Location, "{client_ip}") {
+		return fmt.Errorf("redirect locations can't use {client_ip}")
+	}
+	if r.Path == RedirectPathPreserve && usesPath(r.Location) {
+		return fmt.Errorf("redirect locations using {path}, {path.N} or {rest} would get the path twice with path %q", RedirectPathPreserve)
+	}
+
+	// Expand the template against a dummy request to check both the
+	// placeholders and the resulting URL.
+	location, err := expandURL(r.Location, placeholders{host: "example.com", path: "/", prefix: "/"})
+	if err != nil {
+		return err
+	}
+	if _, err := url.Parse(location); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Target builds the redirect URL for a request to host and requestURL, which
+// matched prefix.
+func (r *Redirect) Target(host string, requestURL *url.URL, prefix string) (*url.URL, error) {
+	location, err := expandURL(r.Location, placeholders{
+		host:   host,
+		path:   requestURL.Path,
+		prefix: prefix,
+		query:  requestURL.RawQuery,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.pathMode() == RedirectPathPreserve {
+		target.Path = path.Join(target.Path, "/"+strings.TrimPrefix(requestURL.Path, prefix))
+	}
+
+	if requestURL.RawQuery != "" {
+		switch r.Query {
+		case "", RedirectQueryReplace:
+			target.RawQuery = requestURL.RawQuery
+		case RedirectQueryMerge:
+			query := target.Query()
+			for key, values := range requestURL.Query() {
+				query[key] = append(query[key], values...)
+			}
+			target.RawQuery = query.Encode()
+		}
+	}
+
+	return target, nil
+}
@@ -0,0 +1,116 @@
+package director
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func TestRouteUnmarshalJSON(t *testing.T) {
+	var routes map[string]*Route
+	if err := json.Unmarshal([]byte(`{
+		"/": "cats",
+		"/static": "/cats_static",
+		"/old": ">https://www.cats.com",
+		"/tmp": {"redirect": {"location": "https://www.cats.com/tmp", "status": 302}}
+	}`), &routes); err != nil {
+		t.Fatal(err)
+	}
+
+	if routes["/"].Service != "cats" || routes["/"].Redirect != nil {
+		t.Errorf("expected a service route, got %+v", routes["/"])
+	}
+	if !routes["/static"].IsStatic() {
+		t.Errorf("expected a static route, got %+v", routes["/static"])
+	}
+	if routes["/old"].Redirect == nil || routes["/old"].Redirect.Location != "https://www.cats.com" || routes["/old"].Redirect.StatusCode() != 301 {
+		t.Errorf("expected a 301 redirect route, got %+v", routes["/old"])
+	}
+	if routes["/tmp"].Redirect == nil || routes["/tmp"].Redirect.StatusCode() != 302 {
+		t.Errorf("expected a 302 redirect route, got %+v", routes["/tmp"])
+	}
+
+	for prefix, route := range routes {
+		if err := route.Validate(); err != nil {
+			t.Errorf("%s: %s", prefix, err)
+		}
+	}
+}
+
+func TestRedirectValidate(t *testing.T) {
+	tests := []struct {
+		redirect Redirect
+		valid    bool
+	}{
+		{Redirect{Location: "https://www.cats.com"}, true},
+		{Redirect{Location: "https://www.cats.com", Status: 308}, true},
+		{Redirect{Location: "https://www.cats.com", Status: 200}, false},
+		{Redirect{Location: "https://www.cats.com", Path: "sideways"}, false},
+		{Redirect{Location: "https://www.cats.com", Query: "shuffle"}, false},
+		{Redirect{Location: "https://{host.0}.cats.com/{rest}", Path: RedirectPathFixed}, true},
+		{Redirect{Location: "https://{host.0}.cats.com/{rest}"}, true},
+		{Redirect{Location: "https://www.cats.com{path}", Path: RedirectPathPreserve}, false},
+		{Redirect{Location: "https://www.cats.com/{path.1}", Path: RedirectPathPreserve}, false},
+		{Redirect{Location: "https://www.cats.com/{nope}"}, false},
+		{Redirect{Location: "https://www.cats.com/{path"}, false},
+		{Redirect{}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.redirect.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid to be %t, got error %v", test.redirect, test.valid, err)
+		}
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	tests := []struct {
+		redirect Redirect
+		host     string
+		request  string
+		prefix   string
+		expected string
+	}{
+		{Redirect{Location: "https://www.cats.com"}, "www.dogs.com", "/", "/", "https://www.cats.com/"},
+		{Redirect{Location: "https://www.cats.com"}, "www.dogs.com", "/brown/good", "/brown", "https://www.cats.com/good"},
+		{Redirect{Location: "https://www.cats.com/new"}, "www.dogs.com", "/brown/good", "/brown", "https://www.cats.com/new/good"},
+		{Redirect{Location: "https://www.cats.com/new", Path: RedirectPathFixed}, "www.dogs.com", "/brown/good", "/brown", "https://www.cats.com/new"},
+		{Redirect{Location: "https://www.cats.com/?a=1"}, "www.dogs.com", "/?b=2", "/", "https://www.cats.com/?b=2"},
+		{Redirect{Location: "https://www.cats.com/?a=1"}, "www.dogs.com", "/", "/", "https://www.cats.com/?a=1"},
+		{Redirect{Location: "https://www.cats.com/?a=1", Query: RedirectQueryMerge}, "www.dogs.com", "/?a=3&b=2", "/", "https://www.cats.com/?a=1&a=3&b=2"},
+		{Redirect{Location: "https://www.cats.com/?a=1", Query: RedirectQueryDrop}, "www.dogs.com", "/?b=2", "/", "https://www.cats.com/?a=1"},
+		{Redirect{Location: "https://{host.0}.cats.com/archive/{path.1}/{rest}", Path: RedirectPathFixed}, "www.dogs.com:8080", "/2012/06/story.html", "/2012", "https://www.cats.com/archive/06/06/story.html"},
+		{Redirect{Location: "https://www.cats.com{path}", Path: RedirectPathFixed}, "www.dogs.com", "/brown/good", "/brown", "https://www.cats.com/brown/good"},
+		{Redirect{Location: "https://www.cats.com/new/{rest}"}, "www.dogs.com", "/brown/good", "/brown", "https://www.cats.com/new/good"},
+		{Redirect{Location: "https://www.cats.com/{path.0}"}, "www.dogs.com", "/caf%C3%A9%20au/good", "/", "https://www.cats.com/caf%C3%A9%20au"},
+		{Redirect{Location: "https://{host.0}.cats.com"}, "www.dogs.com", "/brown/good", "/brown", "https://www.cats.com/good"},
+		{Redirect{Location: "https://www.cats.com/{path.0}/x", Path: RedirectPathFixed}, "www.dogs.com", "/a%3Fb=1/good", "/", "https://www.cats.com/a%3Fb=1/x"},
+		{Redirect{Location: "https://www.cats.com/?from={host.0}&q={path.0}", Query: RedirectQueryDrop, Path: RedirectPathFixed}, "a.dogs.com", "/x&y=1", "/", "https://www.cats.com/?from=a&q=x%26y%3D1"},
+		{Redirect{Location: "https://www.cats.com/{query}", Path: RedirectPathFixed, Query: RedirectQueryDrop}, "www.dogs.com", "/?a=1/b", "/", "https://www.cats.com/a=1%2Fb"},
+	}
+
+	for _, test := range tests {
+		requestURL, err := url.Parse(test.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target, err := test.redirect.Target(test.host, requestURL, test.prefix)
+		if err != nil {
+			t.Errorf("%+v: %s", test.redirect, err)
+			continue
+		}
+		if target.String() != test.expected {
+			t.Errorf("%+v: expected %s to redirect to %s, got %s", test.redirect, test.request, test.expected, target.String())
+		}
+	}
+
+	// Values can't add a user or another host to the location.
+	redirect := Redirect{Location: "https://{host.0}.cats.com/", Path: RedirectPathFixed}
+	if target, err := redirect.Target("evil.com@www.dogs.com", &url.URL{Path: "/"}, "/"); err == nil && target.Host != "evil.cats.com" {
+		t.Errorf("expected the host label to stay in the host, got %s", target)
+	}
+	if target, err := redirect.Target("evil@www.dogs.com", &url.URL{Path: "/"}, "/"); err == nil {
+		t.Errorf("expected an error for a host label with an @, got %s", target)
+	}
+}
@@ -0,0 +1,93 @@
+package director
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Regexp is a regular expression, compiled as it's read from the routes file.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// UnmarshalJSON compiles a regular expression given as a string.
+func (r *Regexp) UnmarshalJSON(data []byte) error {
+	var expr string
+	if err := json.Unmarshal(data, &expr); err != nil {
+		return err
+	}
+
+	compiled, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	r.Regexp = compiled
+	return nil
+}
+
+// PathRewrite describes how a route changes the path of the requests it
+// proxies: by stripping the matched prefix, by replacing it with another, or
+// by a regular expression on the whole path. Replacement may refer to the
+// expression's submatches, e.g. $1.
+type PathRewrite struct {
+	Strip   bool   `json:"strip,omitempty"`
+	Replace string `json:"replace,omitempty"`
+
+	Regex       *Regexp `json:"regex,omitempty"`
+	Replacement string  `json:"replacement,omitempty"`
+}
+
+// Validate checks that exactly one kind of rewrite is given.
+func (p *PathRewrite) Validate() error {
+	defined := 0
+	for _, ok := range []bool{p.Strip, p.Replace != "", p.Regex != nil} {
+		if ok {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return errors.New("a path rewrite needs exactly one of strip, replace or regex")
+	}
+
+	if p.Replace != "" && !strings.HasPrefix(p.Replace, "/") {
+		return errors.New("path rewrite replacement doesn't begin with /")
+	}
+	if p.Regex == nil && p.Replacement != "" {
+		return errors.New("replacement is only supported with regex")
+	}
+	return nil
+}
+
+// Apply rewrites the path of a request that matched prefix.
+func (p *PathRewrite) Apply(requestPath, prefix string) string {
+	if p.Regex != nil {
+		return p.Regex.ReplaceAllString(requestPath, p.Replacement)
+	}
+
+	// Keep whatever follows the prefix, including a trailing slash.
+	rest := strings.TrimPrefix(requestPath, strings.TrimSuffix(prefix, "/"))
+	if rest != "" && !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+
+	rewritten := strings.TrimSuffix(p.Replace, "/") + rest
+	if rewritten == "" {
+		return "/"
+	}
+	return rewritten
+}
+
+// UpstreamPrefix gets the prefix the upstream sees in place of the matched
+// one. There's none for regular expressions, which may move the path
+// anywhere.
+func (p *PathRewrite) UpstreamPrefix() (string, bool) {
+	if p.Regex != nil {
+		return "", false
+	}
+	if p.Strip {
+		return "/", true
+	}
+	return p.Replace, true
+}
@@ -0,0 +1,60 @@
+package director
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPathRewrite(t *testing.T) {
+	tests := []struct {
+		rewrite, prefix, path, expected string
+	}{
+		{`{"strip": true}`, "/projects/app1", "/projects/app1/story", "/story"},
+		{`{"strip": true}`, "/projects/app1", "/projects/app1", "/"},
+		{`{"strip": true}`, "/projects/app1/", "/projects/app1/", "/"},
+		{`{"replace": "/app"}`, "/projects/app1", "/projects/app1/story", "/app/story"},
+		{`{"replace": "/app/"}`, "/projects/app1/", "/projects/app1/", "/app/"},
+		{`{"replace": "/app"}`, "/projects/app1", "/projects/app1", "/app"},
+		{`{"regex": "^/projects/app1/(\\d+)/(.*)$", "replacement": "/$2?id=$1"}`, "/projects/app1", "/projects/app1/42/story", "/story?id=42"},
+		{`{"regex": "^/projects/app1/(\\d+)$", "replacement": "/$1"}`, "/projects/app1", "/projects/app1/story", "/projects/app1/story"},
+	}
+
+	for _, test := range tests {
+		var rewrite PathRewrite
+		if err := json.Unmarshal([]byte(test.rewrite), &rewrite); err != nil {
+			t.Fatal(err)
+		}
+		if err := rewrite.Validate(); err != nil {
+			t.Errorf("%s: %s", test.rewrite, err)
+			continue
+		}
+		if got := rewrite.Apply(test.path, test.prefix); got != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.rewrite, test.path, test.expected, got)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{}`,
+		`{"strip": true, "replace": "/app"}`,
+		`{"replace": "app"}`,
+		`{"strip": true, "replacement": "/$1"}`,
+	} {
+		var rewrite PathRewrite
+		if err := json.Unmarshal([]byte(invalid), &rewrite); err != nil {
+			t.Fatal(err)
+		}
+		if err := rewrite.Validate(); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+
+	var rewrite PathRewrite
+	if err := json.Unmarshal([]byte(`{"regex": "("}`), &rewrite); err == nil {
+		t.Error("expected an error for an invalid regex")
+	}
+
+	route := &Route{Service: "/static_dir", Rewrite: &PathRewrite{Strip: true}}
+	if err := route.Validate(); err == nil {
+		t.Error("expected an error for a static route with a rewrite")
+	}
+}
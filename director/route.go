@@ -0,0 +1,192 @@
+package director
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Route describes how requests matching a host and path prefix are handled.
+//
+// In the routes file a route is either a string pattern or an object. The
+// string pattern is a Kubernetes service name, a static directory beginning
+// with "/", or a redirect target beginning with ">".
+type Route struct {
+	Service  string    `json:"service,omitempty"`
+	Redirect *Redirect `json:"redirect,omitempty"`
+
+	// Targets, in place of a service, splits traffic between several
+	// services by weight.
+	Targets []Target `json:"targets,omitempty"`
+	Sticky  *Sticky  `json:"sticky,omitempty"`
+
+	// Mirror, if set, sends a sample of the route's requests to another
+	// service as well.
+	Mirror *Mirror `json:"mirror,omitempty"`
+
+	// Rewrite, if set, changes the path of the requests the route proxies
+	// to services.
+	Rewrite *PathRewrite `json:"rewrite,omitempty"`
+
+	// Compress, if set, turns compression of the route's responses on or
+	// off, in place of the default.
+	Compress *bool `json:"compress,omitempty"`
+
+	// When, if set, restricts the route to requests meeting the conditions.
+	When *Conditions `json:"when,omitempty"`
+
+	// Headers changes the headers of the requests the route proxies and of
+	// the responses it returns.
+	Headers Headers `json:"headers"`
+}
+
+// NewRoute builds a route from a string pattern.
+func NewRoute(pattern string) *Route {
+	if location := strings.TrimPrefix(pattern, ">"); location != pattern {
+		return &Route{
+			Redirect: &Redirect{Location: location},
+		}
+	}
+
+	return &Route{Service: pattern}
+}
+
+// UnmarshalJSON accepts either a string pattern or a route object.
+func (r *Route) UnmarshalJSON(data []byte) error {
+	var pattern string
+	if err := json.Unmarshal(data, &pattern); err == nil {
+		*r = *NewRoute(pattern)
+		return nil
+	}
+
+	// Use an alias type so that decoding doesn't recurse back into this method.
+	type route Route
+	return json.Unmarshal(data, (*route)(r))
+}
+
+// IsStatic reports whether the route points at a directory on the static
+// file backend.
+func (r *Route) IsStatic() bool {
+	return strings.HasPrefix(r.Service, "/")
+}
+
+// Match reports whether a request meets the route's conditions, if any.
+func (r *Route) Match(req *http.Request) bool {
+	return r.When == nil || r.When.Match(req)
+}
+
+// Validate checks that the route is internally consistent.
+func (r *Route) Validate() error {
+	if r.When != nil {
+		if err := r.When.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.Headers.Validate(); err != nil {
+		return err
+	}
+
+	defined := 0
+	for _, ok := range []bool{r.Service != "", r.Redirect != nil, len(r.Targets) > 0} {
+		if ok {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return errors.New("a route needs exactly one of a service, a redirect or targets")
+	}
+
+	if r.Sticky != nil && len(r.Targets) == 0 {
+		return errors.New("sticky is only supported with targets")
+	}
+
+	if r.Mirror != nil {
+		if r.Redirect != nil || r.IsStatic() {
+			return errors.New("mirror is only supported for services and targets")
+		}
+		if err := r.Mirror.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Compress != nil && r.Redirect != nil {
+		return errors.New("compress isn't supported for redirects")
+	}
+
+	if r.Rewrite != nil {
+		if r.Redirect != nil || r.IsStatic() {
+			return errors.New("rewrite is only supported for services and targets")
+		}
+		if err := r.Rewrite.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Redirect != nil {
+		return r.Redirect.Validate()
+	}
+	if len(r.Targets) > 0 {
+		return validateTargets(r.Targets, r.Sticky)
+	}
+	return nil
+}
+
+// Routes is the list of routes for a single host and path prefix. The first
+// route whose conditions a request meets handles it.
+//
+// In the routes file this is either a single route or an array of routes.
+type Routes []*Route
+
+// UnmarshalJSON accepts either a single route or an array of routes.
+func (rs *Routes) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var routes []*Route
+		if err := json.Unmarshal(data, &routes); err != nil {
+			return err
+		}
+		*rs = routes
+		return nil
+	}
+
+	route := &Route{}
+	if err := json.Unmarshal(data, route); err != nil {
+		return err
+	}
+	*rs = Routes{route}
+	return nil
+}
+
+// Validate checks each route, and that none is unreachable behind a route
+// without conditions.
+func (rs Routes) Validate() error {
+	if len(rs) == 0 {
+		return errors.New("no routes given")
+	}
+
+	for i, route := range rs {
+		if err := route.Validate(); err != nil {
+			if len(rs) > 1 {
+				return fmt.Errorf("route %d: %s", i, err)
+			}
+			return err
+		}
+		if route.When == nil && i < len(rs)-1 {
+			return fmt.Errorf("route %d has no conditions, so the routes after it are unreachable", i)
+		}
+	}
+	return nil
+}
+
+// Match finds the first route whose conditions a request meets.
+func (rs Routes) Match(req *http.Request) *Route {
+	for _, route := range rs {
+		if route.Match(req) {
+			return route
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package director
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// Target is one of several services a route splits traffic between.
+type Target struct {
+	Service string `json:"service"`
+	Weight  int    `json:"weight"`
+}
+
+// Sticky describes how a request is kept on the same target across requests,
+// either by a cookie naming the target or by a hash of a header value.
+type Sticky struct {
+	Cookie string `json:"cookie,omitempty"`
+	Header string `json:"header,omitempty"`
+}
+
+func validateTargets(targets []Target, sticky *Sticky) error {
+	total := 0
+	for _, target := range targets {
+		if target.Service == "" {
+			return errors.New("target service is empty")
+		}
+		if strings.HasPrefix(target.Service, "/") || strings.HasPrefix(target.Service, ">") {
+			return fmt.Errorf("target %s isn't a service", target.Service)
+		}
+		if target.Weight < 0 {
+			return fmt.Errorf("target %s has a negative weight", target.Service)
+		}
+		total += target.Weight
+	}
+
+	if total == 0 {
+		return errors.New("targets have no weight")
+	}
+
+	if sticky != nil && (sticky.Cookie == "") == (sticky.Header == "") {
+		return errors.New("sticky needs exactly one of a cookie or a header")
+	}
+	return nil
+}
+
+// PickTarget chooses a target for a request to a route with targets. If the
+// choice should be remembered with a sticky cookie, a cookie to set on the
+// response is returned as well.
+func (r *Route) PickTarget(req *http.Request) (*Target, *http.Cookie) {
+
+	if r.Sticky != nil && r.Sticky.Cookie != "" {
+		if cookie, err := req.Cookie(r.Sticky.Cookie); err == nil {
+			for i := range r.Targets {
+				if r.Targets[i].Service == cookie.Value && r.Targets[i].Weight > 0 {
+					return &r.Targets[i], nil
+				}
+			}
+		}
+
+		target := r.weightedTarget(rand.Intn(r.totalWeight()))
+		return target, &http.Cookie{
+			Name:     r.Sticky.Cookie,
+			Value:    target.Service,
+			Path:     "/",
+			HttpOnly: true,
+		}
+	}
+
+	if r.Sticky != nil && r.Sticky.Header != "" {
+		if value := req.Header.Get(r.Sticky.Header); value != "" {
+			hash := fnv.New32a()
+			hash.Write([]byte(value))
+			return r.weightedTarget(int(hash.Sum32() % uint32(r.totalWeight()))), nil
+		}
+	}
+
+	return r.weightedTarget(rand.Intn(r.totalWeight())), nil
+}
+
+func (r *Route) totalWeight() int {
+	total := 0
+	for _, target := range r.Targets {
+		total += target.Weight
+	}
+	return total
+}
+
+// weightedTarget finds the target covering n, where 0 <= n < totalWeight.
+func (r *Route) weightedTarget(n int) *Target {
+	for i := range r.Targets {
+		if n < r.Targets[i].Weight {
+			return &r.Targets[i]
+		}
+		n -= r.Targets[i].Weight
+	}
+	return &r.Targets[len(r.Targets)-1]
+}
@@ -0,0 +1,161 @@
+package director
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// placeholders are the values of a request that templates, such as redirect
+// locations and header values, can reference:
+//
+//	{host}       the request host
+//	{host.N}     the Nth dot-separated label of the request host, from 0
+//	{path}       the request path
+//	{path.N}     the Nth segment of the request path, from 0
+//	{prefix}     the matched path prefix
+//	{rest}       the request path following the matched prefix
+//	{query}      the raw request query string
+//	{client_ip}  the IP address of the client
+type placeholders struct {
+	host, path, prefix, query, clientIP string
+}
+
+// expand replaces the placeholders in a template.
+func expand(template string, p placeholders) (string, error) {
+	return expandWith(template, func(name, _ string) (string, error) {
+		return p.value(name)
+	})
+}
+
+// expandURL replaces the placeholders in a URL template, escaping each value
+// for the part of the URL it's in: the host, the path or the query string.
+func expandURL(template string, p placeholders) (string, error) {
+	return expandWith(template, func(name, literal string) (string, error) {
+		value, err := p.value(name)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case strings.ContainsAny(literal, "?#"):
+			// The raw query string is already escaped.
+			if name == "query" {
+				return value, nil
+			}
+			return url.QueryEscape(value), nil
+		case name == "path" || name == "rest" && !inAuthority(literal):
+			// Paths keep their slashes. {path} starts with one, so it also
+			// ends the host.
+			return (&url.URL{Path: value}).EscapedPath(), nil
+		case inAuthority(literal):
+			return escapeHost(value), nil
+		}
+		return url.PathEscape(value), nil
+	})
+}
+
+// inAuthority reports whether the end of the literal text of a URL template
+// is in its host, i.e. follows // at the start or after the scheme with no
+// path begun.
+func inAuthority(literal string) bool {
+	i := strings.Index(literal, "//")
+	if i < 0 || (i > 0 && literal[i-1] != ':') || strings.Contains(literal[:i], "/") {
+		return false
+	}
+	return !strings.Contains(literal[i+2:], "/")
+}
+
+// escapeHost percent-escapes everything but the characters of host names,
+// ports and IPv6 literals.
+func escapeHost(value string) string {
+	var buf []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == ':', c == '[', c == ']':
+			buf = append(buf, c)
+		default:
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
+
+// expandWith replaces each placeholder in a template with the value given
+// for its name and the literal text of the template before it.
+func expandWith(template string, value func(name, literal string) (string, error)) (string, error) {
+	var buf, literal []byte
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in %q", template)
+		}
+		end += start
+
+		literal = append(literal, template[:start]...)
+		v, err := value(template[start+1:end], string(literal))
+		if err != nil {
+			return "", err
+		}
+
+		buf = append(buf, template[:start]...)
+		buf = append(buf, v...)
+		template = template[end+1:]
+	}
+
+	return string(append(buf, template...)), nil
+}
+
+func (p placeholders) value(name string) (string, error) {
+	switch name {
+	case "host":
+		return p.host, nil
+	case "path":
+		return p.path, nil
+	case "prefix":
+		return p.prefix, nil
+	case "rest":
+		return strings.TrimPrefix(strings.TrimPrefix(p.path, p.prefix), "/"), nil
+	case "query":
+		return p.query, nil
+	case "client_ip":
+		return p.clientIP, nil
+	}
+
+	// Indexed captures, e.g. {host.0} or {path.2}.
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		index, err := strconv.Atoi(name[i+1:])
+		if err != nil || index < 0 {
+			return "", fmt.Errorf("bad placeholder index in {%s}", name)
+		}
+
+		var parts []string
+		switch name[:i] {
+		case "host":
+			host := p.host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			parts = strings.Split(host, ".")
+		case "path":
+			parts = strings.Split(strings.Trim(p.path, "/"), "/")
+		default:
+			return "", fmt.Errorf("unknown placeholder {%s}", name)
+		}
+
+		if index < len(parts) {
+			return parts[index], nil
+		}
+		return "", nil
+	}
+
+	return "", fmt.Errorf("unknown placeholder {%s}", name)
+}
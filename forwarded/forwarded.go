@@ -0,0 +1,221 @@
+// Package forwarded works out a request's client IP from the headers set by
+// trusted proxies in front of this one, and sets the X-Forwarded-* and
+// Forwarded headers for upstreams.
+package forwarded
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers that describe the client. They're only believed when they come from
+// a trusted proxy, and are stripped from other requests.
+var clientHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Port",
+	"X-Forwarded-Prefix",
+	"X-Real-IP",
+	"Forwarded",
+	"SRCIP",
+}
+
+// Proxies is a list of the networks of trusted proxies.
+type Proxies []*net.IPNet
+
+// ParseProxies parses a comma separated list of CIDRs or IP addresses.
+func ParseProxies(raw string) (Proxies, error) {
+	var proxies Proxies
+	for _, cidr := range strings.Split(raw, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", cidr, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Contains checks if an address is one of a trusted proxy.
+func (p Proxies) Contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peer gets the IP address of the immediate peer of a request.
+func peer(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// clientIP walks back through the X-Forwarded-For header of a request from a
+// trusted peer, skipping trusted proxies, to the first address that isn't
+// one. That's the furthest address that can be believed.
+func (p Proxies) clientIP(req *http.Request) string {
+	client := peer(req)
+	if !p.Contains(client) {
+		return client
+	}
+
+	var addresses []string
+	for _, value := range req.Header["X-Forwarded-For"] {
+		addresses = append(addresses, strings.Split(value, ",")...)
+	}
+
+	for i := len(addresses) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(addresses[i])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		client = address
+		if !p.Contains(address) {
+			break
+		}
+	}
+	return client
+}
+
+type clientIPKey struct{}
+
+// ClientIP gets the client IP of a request worked out by Handler, or the
+// address of its peer if it hasn't been through Handler.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peer(req)
+}
+
+// forwardedNode formats a peer's address as a node of a Forwarded header.
+// Only the IP is given, whatever its family, as in X-Forwarded-For. IPv6
+// addresses are bracketed and quoted, as are any other addresses that aren't
+// tokens.
+func forwardedNode(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	if strings.Contains(host, ":") {
+		return quote("[" + host + "]")
+	}
+	if !isToken(host) {
+		return quote(host)
+	}
+	return host
+}
+
+// quote makes a quoted-string of s, as RFC 7230 defines it, escaping only
+// double quotes and backslashes. Control characters, which can't be quoted,
+// are dropped.
+func quote(s string) string {
+	buf := make([]byte, 0, len(s)+2)
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\t' || c >= ' ' && c != 0x7f:
+			buf = append(buf, c)
+		}
+	}
+	return string(append(buf, '"'))
+}
+
+// isToken reports whether s is a token, as RFC 7230 defines it, which a
+// Forwarded header value can be without quoting.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler works out the client IP of each request to h, for ClientIP, and
+// sets the headers that describe the client for upstreams. Requests from
+// peers that aren't trusted proxies have those headers stripped first.
+//
+// httputil.ReverseProxy appends the peer to X-Forwarded-For itself, so it's
+// left alone here.
+func (p Proxies) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client := p.clientIP(req)
+		trusted := p.Contains(peer(req))
+
+		if !trusted {
+			for _, header := range clientHeaders {
+				req.Header.Del(header)
+			}
+		}
+
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+
+		element := "for=" + forwardedNode(req.RemoteAddr) + ";host=" + quote(req.Host) + ";proto=" + proto
+		if prior := strings.Join(req.Header["Forwarded"], ", "); prior != "" {
+			element = prior + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clientIPKey{}, client)))
+	})
+}
+
+// AddPrefix sets the X-Forwarded-Prefix header of a request whose path prefix
+// was removed or replaced before proxying it, after any prefix that a trusted
+// proxy in front already removed.
+func AddPrefix(header http.Header, prefix string) {
+	prefix = strings.TrimSuffix(header.Get("X-Forwarded-Prefix"), "/") + strings.TrimSuffix(prefix, "/")
+	if prefix != "" {
+		header.Set("X-Forwarded-Prefix", prefix)
+	}
+}
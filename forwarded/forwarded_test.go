@@ -0,0 +1,163 @@
+package forwarded
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseProxies(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8, 192.168.1.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for address, trusted := range map[string]bool{
+		"10.1.2.3":      true,
+		"192.168.1.1":   true,
+		"192.168.1.2":   false,
+		"2001:db8::1":   true,
+		"2001:db9::1":   false,
+		"not an ip":     false,
+		"203.0.113.195": false,
+	} {
+		if proxies.Contains(address) != trusted {
+			t.Errorf("expected Contains(%q) to be %t", address, trusted)
+		}
+	}
+
+	if _, err := ParseProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+	if _, err := ParseProxies("proxy.example.com"); err == nil {
+		t.Error("expected an error for a hostname")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		clientIP   string
+		expected   http.Header
+	}{
+		{
+			name:       "untrusted peer with spoofed headers",
+			remoteAddr: "203.0.113.195:41000",
+			header: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Proto": {"https"},
+				"Srcip":             {"1.2.3.4"},
+				"Forwarded":         {"for=1.2.3.4"},
+			},
+			clientIP: "203.0.113.195",
+			expected: http.Header{
+				"X-Forwarded-Host":  {"www.example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {`for=203.0.113.195;host="www.example.com";proto=http`},
+			},
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.2:41000",
+			header: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4, 198.51.100.7", "10.0.0.1"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=198.51.100.7;proto=https"},
+			},
+			clientIP: "198.51.100.7",
+			expected: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4, 198.51.100.7", "10.0.0.1"},
+				"X-Forwarded-Host":  {"www.example.com"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {`for=198.51.100.7;proto=https, for=10.0.0.2;host="www.example.com";proto=http`},
+			},
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.2:41000",
+			header:     http.Header{},
+			clientIP:   "10.0.0.2",
+			expected: http.Header{
+				"X-Forwarded-Host":  {"www.example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {`for=10.0.0.2;host="www.example.com";proto=http`},
+			},
+		},
+		{
+			name:       "IPv6 peer",
+			remoteAddr: "[2001:db8::1]:41000",
+			header:     http.Header{},
+			clientIP:   "2001:db8::1",
+			expected: http.Header{
+				"X-Forwarded-Host":  {"www.example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {`for="[2001:db8::1]";host="www.example.com";proto=http`},
+			},
+		},
+	} {
+		var clientIP string
+		var header http.Header
+		handler := proxies.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			clientIP = ClientIP(req)
+			header = req.Header
+		}))
+
+		req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header = test.header
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if clientIP != test.clientIP {
+			t.Errorf("%s: expected client IP %s, got %s", test.name, test.clientIP, clientIP)
+		}
+		if len(header) != len(test.expected) {
+			t.Errorf("%s: expected headers %v, got %v", test.name, test.expected, header)
+			continue
+		}
+		for key, values := range test.expected {
+			if len(header[key]) != len(values) {
+				t.Errorf("%s: expected %s %v, got %v", test.name, key, values, header[key])
+				continue
+			}
+			for i := range values {
+				if header[key][i] != values[i] {
+					t.Errorf("%s: expected %s %v, got %v", test.name, key, values, header[key])
+				}
+			}
+		}
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	for _, test := range []struct {
+		remoteAddr, expected string
+	}{
+		{"192.0.2.43:47011", "192.0.2.43"},
+		{"192.0.2.43", "192.0.2.43"},
+		{"[2001:db8:cafe::17]:4711", `"[2001:db8:cafe::17]"`},
+		{"2001:db8:cafe::17", `"[2001:db8:cafe::17]"`},
+		{"@", `"@"`},
+	} {
+		if got := forwardedNode(test.remoteAddr); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.remoteAddr, test.expected, got)
+		}
+	}
+
+	for s, expected := range map[string]string{
+		"www.example.com": `"www.example.com"`,
+		`say "cheese"`:    `"say \"cheese\""`,
+		`back\slash`:      `"back\\slash"`,
+		"café\x00\r\n":    "\"café\"",
+	} {
+		if got := quote(s); got != expected {
+			t.Errorf("%q: expected %s, got %s", s, expected, got)
+		}
+	}
+}
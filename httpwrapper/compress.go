@@ -0,0 +1,349 @@
+package httpwrapper
+
+// A handler wrapper which compresses responses as they're written.
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/tracing"
+)
+
+const (
+	// DefaultMinCompressSize is roughly the MTU size. Responses smaller than
+	// this fit in a packet anyway.
+	DefaultMinCompressSize = 1000
+)
+
+var (
+	// DefaultCompressibleTypes are the media types compressed unless the
+	// compressor is given others.
+	DefaultCompressibleTypes = []string{
+		"application/atom+xml",
+		"application/javascript",
+		"application/json",
+		"application/rss+xml",
+		"application/vnd.ms-fontobject",
+		"application/x-font-ttf",
+		"application/x-web-app-manifest+json",
+		"application/xhtml+xml",
+		"application/xml",
+		"font/opentype",
+		"image/svg+xml",
+		"image/x-icon",
+		"text/*",
+	}
+)
+
+// Compressor compresses responses with the content coding each client
+// prefers, reusing encoders between responses.
+type Compressor struct {
+	// Levels gives the level to compress responses at with each content
+	// coding: Brotli, Zstd or Gzip. Codings without a level aren't used.
+	Levels map[string]int
+
+	// Types are the media types to compress, which may have a wildcard
+	// subtype, e.g. text/*. Nil means DefaultCompressibleTypes.
+	Types []string
+
+	// MinSize is the smallest response to compress, if its length is known.
+	MinSize int64
+
+	// Recompress compresses responses the transport decoded for clients
+	// which don't accept gzip, with a coding they do accept.
+	Recompress bool
+
+	// Metrics, if set, receives the compression metrics.
+	Metrics metrics.Metrics
+
+	once  sync.Once
+	pools map[string]*sync.Pool
+}
+
+// pool gets the pool of encoders for a content coding.
+func (c *Compressor) pool(encodingName string) *sync.Pool {
+	c.once.Do(func() {
+		c.pools = make(map[string]*sync.Pool)
+		for name, level := range c.Levels {
+			name, level := name, level
+			if level == 0 {
+				continue
+			}
+			c.pools[name] = &sync.Pool{
+				New: func() interface{} {
+					e, err := encodings[name].newWriter(ioutil.Discard, level)
+					if err != nil {
+						log.Errorln(err)
+						return nil
+					}
+					return e
+				},
+			}
+		}
+	})
+	return c.pools[encodingName]
+}
+
+// enabled reports whether any content coding is enabled.
+func (c *Compressor) enabled() bool {
+	for _, level := range c.Levels {
+		if level != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compressable reports whether a response to req, with status and header,
+// may be compressed.
+func (c *Compressor) compressable(req *http.Request, status int, header http.Header) bool {
+
+	// Responses without a body, and partial content, which can't be
+	// compressed on its own, are left alone.
+	if bodyless(status) {
+		return false
+	}
+	if status == http.StatusPartialContent || header.Get("content-range") != "" {
+		return false
+	}
+
+	// Check if content length was defined. If it is and its value is lower than
+	// the minimum size, this isn't something we should try and compress.
+	if length, err := strconv.ParseInt(header.Get("content-length"), 10, 64); err == nil && length < c.MinSize {
+		return false
+	}
+
+	// Check if the content has already been encoded.
+	responseEncoding := header.Get("content-encoding")
+	if responseEncoding != "" && !strings.EqualFold(responseEncoding, "identity") {
+		return false
+	}
+
+	// Either side can forbid changing the body.
+	if noTransform(req.Header) || noTransform(header) {
+		return false
+	}
+
+	// Check if a response type has been defined.
+	responseType := header.Get("content-type")
+	if responseType == "" {
+		return false
+	}
+
+	// Then look through the list.
+	types := c.Types
+	if types == nil {
+		types = DefaultCompressibleTypes
+	}
+	return matchMediaType(types, responseType)
+}
+
+// compression is whether a request's response may be compressed, which its
+// route can change once it's known, and whether the transport decoded it.
+type compression struct {
+	disabled     bool
+	decompressed bool
+}
+
+type compressionKey struct{}
+
+// SetCompression says whether a request's response may be compressed, e.g.
+// following its route. Responses may be compressed unless it's said
+// otherwise.
+func SetCompression(req *http.Request, enabled bool) {
+	if state, ok := req.Context().Value(compressionKey{}).(*compression); ok {
+		state.disabled = !enabled
+	}
+}
+
+// Handler compresses the responses written by h.
+func (c *Compressor) Handler(h http.Handler) http.Handler {
+	if !c.enabled() {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		state := &compression{}
+		req = req.WithContext(context.WithValue(req.Context(), compressionKey{}, state))
+
+		cw := &compressWriter{ResponseWriter: w, compressor: c, req: req, state: state}
+		defer cw.close()
+
+		if _, ok := w.(http.Hijacker); ok {
+			h.ServeHTTP(hijackCompressWriter{cw}, req)
+			return
+		}
+		h.ServeHTTP(cw, req)
+	})
+}
+
+// countingWriter counts the bytes written through it, and the time spent
+// waiting on writes.
+type countingWriter struct {
+	io.Writer
+	n    int64
+	wait time.Duration
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.Writer.Write(p)
+	w.wait += time.Since(start)
+	w.n += int64(n)
+	return n, err
+}
+
+// compressWriter decides whether to compress a response once its header is
+// written, and then compresses the body as it's written.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+	req        *http.Request
+	state      *compression
+
+	wroteHeader bool
+
+	// Set if the response is being compressed.
+	encodingName string
+	encoder      encoder
+	compressed   countingWriter
+	n            int64
+	busy         time.Duration
+	span         *tracing.Span
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	// Informational responses, like 103 Early Hints, come before the final
+	// one, which is what's compressed.
+	if w.wroteHeader || status >= 100 && status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.ResponseWriter.Header()
+	recompress := !w.state.decompressed || w.compressor.Recompress
+	if !w.state.disabled && recompress && w.compressor.compressable(w.req, status, header) {
+		// Caches in front need to know that the response depends on the
+		// client's Accept-Encoding, whether or not this client gets it
+		// compressed.
+		addVary(header, "Accept-Encoding")
+		if encodingName := negotiateEncoding(w.req, w.compressor.Levels); encodingName != "" {
+			w.start(encodingName)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// start sets up compression of the response with a content coding.
+func (w *compressWriter) start(encodingName string) {
+	header := w.ResponseWriter.Header()
+
+	// Responses to HEAD requests have no body to compress, but get the
+	// same headers as they would for a GET.
+	if w.req.Method != http.MethodHead {
+		e, _ := w.compressor.pool(encodingName).Get().(encoder)
+		if e == nil {
+			return
+		}
+		w.compressed.Writer = w.ResponseWriter
+		e.Reset(&w.compressed)
+		w.encoder = e
+		w.span = tracing.FromRequest(w.req).Child("compress", tracing.Internal)
+	}
+
+	w.encodingName = encodingName
+	header.Set("content-encoding", encodingName)
+	header.Del("content-length")
+	weakenETag(header)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(p)
+	}
+
+	start := time.Now()
+	n, err := w.encoder.Write(p)
+	w.busy += time.Since(start)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush sends what's been compressed so far, for streamed responses.
+func (w *compressWriter) Flush() {
+	if w.encoder != nil {
+		start := time.Now()
+		if err := w.encoder.Flush(); err != nil {
+			log.Errorln(err)
+		}
+		w.busy += time.Since(start)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close finishes the compressed body, returns the encoder to its pool and
+// records how well and how fast the body compressed.
+func (w *compressWriter) close() {
+	if w.encoder == nil {
+		return
+	}
+
+	start := time.Now()
+	if err := w.encoder.Close(); err != nil {
+		log.Errorln(err)
+	}
+	w.busy += time.Since(start)
+
+	// Don't keep a reference to the response in the pool.
+	w.encoder.Reset(ioutil.Discard)
+	w.compressor.pool(w.encodingName).Put(w.encoder)
+	w.encoder = nil
+
+	// The time not spent waiting on the client is roughly the CPU time
+	// spent compressing.
+	busy := w.busy - w.compressed.wait
+
+	w.span.SetAttribute("proxy.compression.encoding", w.encodingName)
+	w.span.SetAttribute("proxy.compression.bytes_in", w.n)
+	w.span.SetAttribute("proxy.compression.bytes_out", w.compressed.n)
+	w.span.End()
+
+	m := metrics.OrNop(w.compressor.Metrics)
+	tags := requestTags(w.req, "encoding:"+w.encodingName)
+	m.Timing("compression_duration", busy, tags)
+	if w.n > 0 {
+		m.Histogram("compression_ratio", float64(w.compressed.n)/float64(w.n), tags)
+	}
+}
+
+// hijackCompressWriter is a compressWriter for connections that can be
+// hijacked, e.g. to upgrade them to websockets.
+type hijackCompressWriter struct {
+	*compressWriter
+}
+
+func (w hijackCompressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
@@ -0,0 +1,312 @@
+package httpwrapper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var decoders = map[string]func(io.Reader) (io.Reader, error){
+	"": func(r io.Reader) (io.Reader, error) { return r, nil },
+	Brotli: func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	},
+	Zstd: func(r io.Reader) (io.Reader, error) {
+		return zstd.NewReader(r)
+	},
+	Gzip: func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+func TestCompressor(t *testing.T) {
+	body := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100)
+
+	compressor := &Compressor{Levels: map[string]int{Brotli: 4, Zstd: 3, Gzip: 4}}
+	handler := compressor.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/off" {
+			SetCompression(req, false)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Vary", "Cookie")
+		if req.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if req.Method != http.MethodHead {
+			io.WriteString(w, body)
+		}
+	}))
+
+	for _, test := range []struct {
+		method, path, acceptEncoding, encoding, etag string
+		vary                                         int
+	}{
+		{"GET", "/", "", "", `"abc"`, 2},
+		{"GET", "/", "gzip", Gzip, `W/"abc"`, 2},
+		{"GET", "/", "gzip, br", Brotli, `W/"abc"`, 2},
+		{"GET", "/", "zstd, gzip;q=0.5", Zstd, `W/"abc"`, 2},
+		{"HEAD", "/", "gzip", Gzip, `W/"abc"`, 2},
+		{"GET", "/off", "gzip", "", `"abc"`, 1},
+		{"GET", "/empty", "gzip", "", `"abc"`, 1},
+	} {
+		req := httptest.NewRequest(test.method, "http://www.cats.com"+test.path, nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		name := test.method + " " + test.path + " " + test.acceptEncoding
+		header := w.Result().Header
+		if got := header.Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("%q: expected Content-Encoding %q, got %q", name, test.encoding, got)
+			continue
+		}
+		if got := header.Get("ETag"); got != test.etag {
+			t.Errorf("%q: expected ETag %s, got %s", name, test.etag, got)
+		}
+		if got := header["Vary"]; len(got) != test.vary || got[len(got)-1] != "Accept-Encoding" && test.vary == 2 {
+			t.Errorf("%q: expected %d Vary headers, got %q", name, test.vary, got)
+		}
+		if test.encoding != "" && header.Get("Content-Length") != "" {
+			t.Errorf("%q: expected no Content-Length, got %s", name, header.Get("Content-Length"))
+		}
+		if test.method == "HEAD" || test.path == "/empty" {
+			if w.Body.Len() != 0 {
+				t.Errorf("%q: expected no body, got %d bytes", name, w.Body.Len())
+			}
+			continue
+		}
+
+		decoded, err := decoders[test.encoding](w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, []byte(body)) {
+			t.Errorf("%q: body didn't survive the round trip", name)
+		}
+	}
+}
+
+func TestCompressorEarlyHints(t *testing.T) {
+	body := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100)
+
+	compressor := &Compressor{Levels: map[string]int{Gzip: 4}}
+	server := httptest.NewServer(compressor.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</cat.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, body)
+	})))
+	defer server.Close()
+
+	var hints []int
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, code)
+			return nil
+		},
+	}))
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if len(hints) != 1 || hints[0] != http.StatusEarlyHints {
+		t.Errorf("expected 103 Early Hints to be passed on, got %v", hints)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != Gzip {
+		t.Errorf("expected the final response to be compressed, got Content-Encoding %q", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("expected Vary Accept-Encoding, got %q", got)
+	}
+	decoded, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(decoded); err != nil || string(got) != body {
+		t.Errorf("body didn't survive the round trip: %v", err)
+	}
+}
+
+func TestCompressorFlush(t *testing.T) {
+	chunks := []string{"data: one\n\n", "data: two\n\n"}
+	next := make(chan struct{})
+
+	compressor := &Compressor{Levels: map[string]int{Gzip: 4}, Types: []string{"text/event-stream"}}
+	server := httptest.NewServer(compressor.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	})))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Encoding"); got != Gzip {
+		t.Fatalf("expected Content-Encoding gzip, got %q", got)
+	}
+
+	// Each chunk has to be readable before the handler writes the next, or
+	// this would block.
+	decoded, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		got := make([]byte, len(chunk))
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(decoded, got)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", chunk)
+		}
+		if string(got) != chunk {
+			t.Errorf("expected %q, got %q", chunk, got)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestCompressable(t *testing.T) {
+	compressor := &Compressor{MinSize: 1000}
+	textOnly := &Compressor{Types: []string{"text/*"}}
+
+	tests := []struct {
+		compressor     *Compressor
+		requestHeader  http.Header
+		status         int
+		responseHeader http.Header
+		expected       bool
+	}{
+		{compressor, nil, 200, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, true},
+		{compressor, nil, 200, http.Header{"Content-Type": {"Application/JSON"}, "Content-Length": {"2000"}}, true},
+		{compressor, nil, 200, http.Header{"Content-Type": {"text/html"}, "Content-Length": {"999"}}, false},
+		{compressor, nil, 200, http.Header{"Content-Type": {"image/png"}}, false},
+		{compressor, nil, 200, http.Header{}, false},
+		{compressor, nil, 200, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}}, false},
+		{compressor, nil, 200, http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"public, no-transform"}}, false},
+		{compressor, http.Header{"Cache-Control": {"no-transform"}}, 200, http.Header{"Content-Type": {"text/html"}}, false},
+		{compressor, nil, 206, http.Header{"Content-Type": {"text/html"}, "Content-Range": {"bytes 0-99/2000"}}, false},
+		{compressor, nil, 304, http.Header{"Content-Type": {"text/html"}}, false},
+		{compressor, nil, 101, http.Header{"Content-Type": {"text/html"}}, false},
+		{textOnly, nil, 200, http.Header{"Content-Type": {"text/css"}, "Content-Length": {"10"}}, true},
+		{textOnly, nil, 200, http.Header{"Content-Type": {"application/json"}}, false},
+		{textOnly, nil, 200, http.Header{"Content-Type": {"textual/css"}}, false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://www.cats.com/", nil)
+		if test.requestHeader != nil {
+			req.Header = test.requestHeader
+		}
+		if got := test.compressor.compressable(req, test.status, test.responseHeader); got != test.expected {
+			t.Errorf("%d %v: expected %t, got %t", test.status, test.responseHeader, test.expected, got)
+		}
+	}
+
+	for _, invalid := range []string{"text", "text/", "*/html", "text/x-*", "/html"} {
+		if err := ValidateMediaTypes([]string{invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+	if err := ValidateMediaTypes([]string{"*/*", "text/*", "application/json"}); err != nil {
+		t.Error(err)
+	}
+}
+
+// benchmarkBody is a typical HTML page, large enough to compress.
+var benchmarkBody = []byte(strings.Repeat(`<li class="story"><a href="/2016/01/01/cats.html">The quick brown fox jumps over the lazy dog</a></li>`+"\n", 500))
+
+// BenchmarkCompressPipe measures compressing responses the way the
+// transport used to: a new encoder per response, fed by a goroutine through
+// a pipe.
+func BenchmarkCompressPipe(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkBody)))
+
+	for i := 0; i < b.N; i++ {
+		pipeReader, pipeWriter := io.Pipe()
+		go func(r io.Reader) {
+			encoder, err := gzip.NewWriterLevel(pipeWriter, 4)
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			io.Copy(encoder, r)
+			encoder.Close()
+			pipeWriter.Close()
+		}(bytes.NewReader(benchmarkBody))
+
+		if _, err := io.Copy(ioutil.Discard, pipeReader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// discardResponseWriter is a ResponseWriter which throws the body away, so
+// the benchmarks measure compression rather than a recorder's buffer.
+type discardResponseWriter http.Header
+
+func (w discardResponseWriter) Header() http.Header         { return http.Header(w) }
+func (w discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
+
+// BenchmarkCompressHandler measures compressing responses as they're written,
+// with pooled encoders.
+func BenchmarkCompressHandler(b *testing.B) {
+	compressor := &Compressor{Levels: map[string]int{Gzip: 4}}
+	handler := compressor.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(benchmarkBody)
+	}))
+	req := httptest.NewRequest("GET", "http://www.cats.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkBody)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(discardResponseWriter(http.Header{}), req)
+	}
+}
@@ -0,0 +1,35 @@
+package httpwrapper
+
+import (
+	"context"
+	"net/http"
+)
+
+type rewriteKey struct{}
+
+// WithRewrite gets a copy of a request carrying how its URL was mapped to
+// the upstream, so that URLs in the upstream's response headers can be mapped
+// back.
+func WithRewrite(req *http.Request, rewrite *Rewrite) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), rewriteKey{}, rewrite))
+}
+
+// rewriteFrom gets the mapping carried by a request, if any.
+func rewriteFrom(req *http.Request) *Rewrite {
+	rewrite, _ := req.Context().Value(rewriteKey{}).(*Rewrite)
+	return rewrite
+}
+
+type debugKey struct{}
+
+// WithDebug gets a copy of a request whose response should carry debug
+// headers.
+func WithDebug(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), debugKey{}, true))
+}
+
+// debug reports whether a request's response should carry debug headers.
+func debug(req *http.Request) bool {
+	enabled, _ := req.Context().Value(debugKey{}).(bool)
+	return enabled
+}
@@ -0,0 +1,106 @@
+package httpwrapper
+
+// Decoding gzip responses for clients that can't read them.
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	gzipReaders sync.Pool
+)
+
+// acceptsEncoding reports whether a client accepts a content coding, going
+// by its Accept-Encoding header.
+func acceptsEncoding(req *http.Request, name string) bool {
+	accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+	q, ok := accepted[name]
+	if !ok {
+		q = accepted["*"]
+	}
+	return q > 0
+}
+
+// decompressable reports whether an upstream's response to req is gzip the
+// client can't read, and can be decoded for it.
+func decompressable(req *http.Request, resp *http.Response) bool {
+	responseEncoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("content-encoding")))
+	if responseEncoding != Gzip && responseEncoding != "x-gzip" {
+		return false
+	}
+	if acceptsEncoding(req, Gzip) {
+		return false
+	}
+
+	// Responses without a body have nothing to decode, and partial content
+	// can't be decoded without the rest of it.
+	if req.Method == http.MethodHead || bodyless(resp.StatusCode) || resp.ContentLength == 0 {
+		return false
+	}
+	if resp.StatusCode == http.StatusPartialContent || resp.Header.Get("content-range") != "" {
+		return false
+	}
+
+	// The upstream can forbid changing the body.
+	return !noTransform(resp.Header)
+}
+
+// gzipBody decodes a gzip response body as it's read.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	if b.Reader != nil {
+		gzipReaders.Put(b.Reader)
+		b.Reader = nil
+	}
+	return b.body.Close()
+}
+
+// decompressResponse replaces a gzip response body with the decoded one,
+// reporting whether it did. An empty body, despite its Content-Encoding, is
+// left alone.
+func decompressResponse(req *http.Request, resp *http.Response) (bool, error) {
+	r, _ := gzipReaders.Get().(*gzip.Reader)
+	var err error
+	if r == nil {
+		r, err = gzip.NewReader(resp.Body)
+	} else {
+		err = r.Reset(resp.Body)
+	}
+	if err == io.EOF {
+		if r != nil {
+			gzipReaders.Put(r)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body = &gzipBody{Reader: r, body: resp.Body}
+
+	resp.Header.Del("content-encoding")
+	resp.Header.Del("content-length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	addVary(resp.Header, "Accept-Encoding")
+	weakenETag(resp.Header)
+
+	// Let the compressor know the response was sent compressed, in case it
+	// shouldn't be again.
+	if state, ok := req.Context().Value(compressionKey{}).(*compression); ok {
+		state.decompressed = true
+	}
+	return true, nil
+}
+
+// bodyless reports whether responses with a status have no body.
+func bodyless(status int) bool {
+	return status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified
+}
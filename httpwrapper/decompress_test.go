@@ -0,0 +1,137 @@
+package httpwrapper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransportDecompression(t *testing.T) {
+	body := []byte("The quick brown fox jumps over the lazy dog.")
+	var buf bytes.Buffer
+	encoder := gzip.NewWriter(&buf)
+	encoder.Write(body)
+	encoder.Close()
+	compressed := buf.Bytes()
+
+	// Responses to these paths have no body, despite being gzip.
+	empty := map[string]bool{"/empty": true, "/empty-chunked": true, "/not-modified": true}
+
+	transport := &Transport{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{
+				"Content-Type":     {"text/plain"},
+				"Content-Encoding": {"gzip"},
+				"Content-Length":   {strconv.Itoa(len(compressed))},
+				"Etag":             {`"abc"`},
+			}
+			status := http.StatusOK
+			body, length := compressed, int64(len(compressed))
+			if empty[req.URL.Path] {
+				body, length = nil, 0
+			}
+			switch req.URL.Path {
+			case "/empty-chunked":
+				header.Del("Content-Length")
+				length = -1
+			case "/not-modified":
+				status = http.StatusNotModified
+			case "/no-transform":
+				header.Set("Cache-Control", "no-transform")
+			case "/partial":
+				status = http.StatusPartialContent
+				header.Set("Content-Range", "bytes 0-9/100")
+			}
+			return &http.Response{
+				StatusCode:    status,
+				Header:        header,
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: length,
+			}, nil
+		}),
+	}
+
+	for _, test := range []struct {
+		method, path, acceptEncoding string
+		decoded                      bool
+	}{
+		{"GET", "/", "", true},
+		{"GET", "/", "gzip", false},
+		{"GET", "/", "gzip, br", false},
+		{"GET", "/", "br", true},
+		{"GET", "/", "*", false},
+		{"GET", "/", "gzip;q=0, *", true},
+		{"GET", "/no-transform", "", false},
+		{"GET", "/partial", "", false},
+		{"HEAD", "/", "", false},
+		{"GET", "/empty", "", false},
+		{"GET", "/empty-chunked", "", false},
+		{"GET", "/not-modified", "", false},
+	} {
+		req, _ := http.NewRequest(test.method, "http://www.cats.com"+test.path, nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		name := test.method + " " + test.path + " " + test.acceptEncoding
+		if !test.decoded {
+			expected := compressed
+			if empty[test.path] {
+				expected = nil
+			}
+			if resp.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(got, expected) {
+				t.Errorf("%q: expected the gzip response untouched", name)
+			}
+			continue
+		}
+
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%q: expected no Content-Encoding, got %q", name, encoding)
+		}
+		if length := resp.Header.Get("Content-Length"); length != "" {
+			t.Errorf("%q: expected no Content-Length, got %s", name, length)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `W/"abc"` {
+			t.Errorf("%q: expected a weak ETag, got %s", name, etag)
+		}
+		if vary := resp.Header.Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("%q: expected Vary Accept-Encoding, got %q", name, vary)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%q: expected %q, got %q", name, body, got)
+		}
+	}
+
+	broken := &Transport{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Encoding": {"gzip"}},
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: -1,
+			}, nil
+		}),
+	}
+	req, _ := http.NewRequest("GET", "http://www.cats.com/", nil)
+	if _, err := broken.RoundTrip(req); err == nil {
+		t.Error("expected an error for a response that isn't really gzip")
+	}
+}
@@ -0,0 +1,213 @@
+package httpwrapper
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings the proxy can compress responses with.
+const (
+	Brotli = "br"
+	Zstd   = "zstd"
+	Gzip   = "gzip"
+)
+
+// zstdWindowSize is the largest window browsers accept for zstd content
+// encoding.
+const zstdWindowSize = 8 << 20
+
+// encoder is a compressing writer which can be flushed, and reset to be
+// reused for another response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoding describes how to compress with a content coding.
+type encoding struct {
+	minLevel, maxLevel int
+	newWriter          func(w io.Writer, level int) (encoder, error)
+}
+
+var (
+	encodings = map[string]encoding{
+		Brotli: {1, brotli.BestCompression, func(w io.Writer, level int) (encoder, error) {
+			return brotli.NewWriterLevel(w, level), nil
+		}},
+		Zstd: {1, 22, func(w io.Writer, level int) (encoder, error) {
+			e, err := zstd.NewWriter(w,
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+				zstd.WithEncoderConcurrency(1),
+				zstd.WithWindowSize(zstdWindowSize),
+			)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		}},
+		Gzip: {gzip.HuffmanOnly, gzip.BestCompression, func(w io.Writer, level int) (encoder, error) {
+			e, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		}},
+	}
+
+	// encodingPreference breaks ties between codings a client accepts
+	// equally, best compression first.
+	encodingPreference = []string{Brotli, Zstd, Gzip}
+)
+
+// ValidateCompressionLevels checks that the level of each coding is within
+// its range. A level of 0 disables a coding.
+func ValidateCompressionLevels(levels map[string]int) error {
+	for name, level := range levels {
+		encoding, ok := encodings[name]
+		if !ok {
+			return fmt.Errorf("unknown content coding %q", name)
+		}
+		if level != 0 && (level < encoding.minLevel || level > encoding.maxLevel) {
+			return fmt.Errorf("%s compression level %d isn't between %d and %d", name, level, encoding.minLevel, encoding.maxLevel)
+		}
+	}
+	return nil
+}
+
+// acceptedEncodings parses an Accept-Encoding header into the quality value
+// of each coding.
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, element := range strings.Split(header, ",") {
+		params := strings.Split(element, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		if name == "x-gzip" {
+			name = Gzip
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil && value >= 0 && value <= 1 {
+					q = value
+				} else {
+					q = 0
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// negotiateEncoding picks the coding to compress a response to req with: the
+// enabled coding the client gives the highest quality value, or "" if it
+// accepts none of them.
+func negotiateEncoding(req *http.Request, levels map[string]int) string {
+	header := req.Header.Get("Accept-Encoding")
+	if header == "" {
+		return ""
+	}
+	accepted := acceptedEncodings(header)
+
+	best, bestQ := "", 0.0
+	for _, name := range encodingPreference {
+		if levels[name] == 0 {
+			continue
+		}
+
+		q, ok := accepted[name]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// addVary adds a header name to a response's Vary header, unless it's
+// already there.
+func addVary(header http.Header, name string) {
+	for _, value := range header["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// weakenETag marks a strong ETag as weak, since a compressed body is no
+// longer byte for byte the one the upstream tagged.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// ValidateMediaTypes checks a list of media types to compress. A type may
+// have a wildcard subtype, e.g. text/*, or be */* for everything.
+func ValidateMediaTypes(types []string) error {
+	for _, mediaType := range types {
+		i := strings.IndexByte(mediaType, '/')
+		if i < 1 || i == len(mediaType)-1 || strings.Contains(mediaType[i+1:], "/") {
+			return fmt.Errorf("invalid media type %q", mediaType)
+		}
+		if strings.Contains(mediaType[:i], "*") && mediaType != "*/*" {
+			return fmt.Errorf("invalid media type %q: only subtypes can be wildcards", mediaType)
+		}
+		if subtype := mediaType[i+1:]; strings.Contains(subtype, "*") && subtype != "*" {
+			return fmt.Errorf("invalid media type %q: only whole subtypes can be wildcards", mediaType)
+		}
+	}
+	return nil
+}
+
+// matchMediaType reports whether the media type of a Content-Type header is
+// one of types.
+func matchMediaType(types []string, contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	for _, mediaType := range types {
+		mediaType = strings.ToLower(mediaType)
+		switch {
+		case mediaType == "*/*", mediaType == contentType:
+			return true
+		case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(contentType, mediaType[:len(mediaType)-1]):
+			return true
+		}
+	}
+	return false
+}
+
+// noTransform reports whether a Cache-Control header forbids changing the
+// body.
+func noTransform(header http.Header) bool {
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package httpwrapper
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	all := map[string]int{Brotli: 4, Zstd: 3, Gzip: 4}
+	gzipOnly := map[string]int{Gzip: 4}
+
+	tests := []struct {
+		acceptEncoding string
+		levels         map[string]int
+		expected       string
+	}{
+		{"", all, ""},
+		{"gzip", all, Gzip},
+		{"gzip, deflate, br", all, Brotli},
+		{"gzip, deflate, br, zstd", all, Brotli},
+		{"br;q=0.5, zstd", all, Zstd},
+		{"gzip;q=0", all, ""},
+		{"GZIP;Q=0.8", all, Gzip},
+		{"x-gzip", all, Gzip},
+		{"*", all, Brotli},
+		{"*;q=0.1, br;q=0", all, Zstd},
+		{"identity", all, ""},
+		{"br", gzipOnly, ""},
+		{"br, gzip;q=0.1", gzipOnly, Gzip},
+		{"gzip;q=nope", all, ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://www.cats.com/", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		if got := negotiateEncoding(req, test.levels); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.acceptEncoding, test.expected, got)
+		}
+	}
+
+	if err := ValidateCompressionLevels(map[string]int{Brotli: 12}); err == nil {
+		t.Error("expected an error for brotli level 12")
+	}
+	if err := ValidateCompressionLevels(map[string]int{"deflate": 1}); err == nil {
+		t.Error("expected an error for deflate")
+	}
+}
@@ -0,0 +1,164 @@
+package httpwrapper
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Rewrite describes how a request's URL was mapped to its upstream, the
+// equivalent of nginx's proxy_redirect and proxy_cookie_domain and
+// proxy_cookie_path. The upstream's view of a URL is its own host, or the
+// Host header it was sent, followed by UpstreamPrefix. The client's is Host
+// followed by Prefix.
+type Rewrite struct {
+	Host                   string
+	Prefix, UpstreamPrefix string
+}
+
+// Response rewrites the URLs in the Location, Content-Location and Refresh
+// headers of a response to req, and the Domain and Path of its cookies.
+//
+// Absolute URLs to the upstream's own address become relative to the
+// client's host. Those to the Host header the upstream was sent keep their
+// scheme and host. Either way, a path beginning with UpstreamPrefix has it
+// replaced by Prefix, as do relative paths.
+func (r *Rewrite) Response(resp *http.Response, req *http.Request) {
+	if r == nil {
+		return
+	}
+
+	upstreamHosts := []string{hostname(req.URL.Host), hostname(req.Host)}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(name); value != "" {
+			resp.Header.Set(name, r.url(value, upstreamHosts))
+		}
+	}
+
+	if refresh := resp.Header.Get("Refresh"); refresh != "" {
+		resp.Header.Set("Refresh", r.refresh(refresh, upstreamHosts))
+	}
+
+	cookies := resp.Header["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = r.cookie(cookie, upstreamHosts)
+	}
+}
+
+// url rewrites an absolute URL or path.
+func (r *Rewrite) url(value string, upstreamHosts []string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+
+	changed := false
+	if u.Host != "" {
+		host := hostname(u.Host)
+		switch {
+		case strings.EqualFold(host, hostname(r.Host)):
+		case containsFold(upstreamHosts, host):
+			u.Scheme, u.User, u.Host = "", nil, ""
+			changed = true
+		default:
+			return value
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	} else if u.Scheme != "" || !strings.HasPrefix(u.Path, "/") {
+		// Opaque URLs, like mailto:, and paths relative to the current
+		// document are left alone.
+		return value
+	}
+
+	if p := r.path(u.Path); p != u.Path {
+		u.Path, u.RawPath = p, ""
+		changed = true
+	}
+
+	if !changed {
+		return value
+	}
+	return u.String()
+}
+
+// path replaces UpstreamPrefix at the start of a path with Prefix.
+func (r *Rewrite) path(p string) string {
+	from, to := withSlash(r.UpstreamPrefix), withSlash(r.Prefix)
+	if from == to {
+		return p
+	}
+	if strings.HasPrefix(p, from) {
+		return to + p[len(from):]
+	}
+	if p+"/" == from {
+		return to
+	}
+	return p
+}
+
+// refresh rewrites the URL in a Refresh header, e.g. "5; url=/next".
+func (r *Rewrite) refresh(value string, upstreamHosts []string) string {
+	i := strings.Index(strings.ToLower(value), "url=")
+	if i < 0 {
+		return value
+	}
+
+	target := strings.TrimSpace(value[i+4:])
+	quote := ""
+	if len(target) > 1 && (target[0] == '\'' || target[0] == '"') && target[len(target)-1] == target[0] {
+		quote, target = target[:1], target[1:len(target)-1]
+	}
+	return value[:i+4] + quote + r.url(target, upstreamHosts) + quote
+}
+
+// cookie rewrites the Domain and Path attributes of a Set-Cookie header.
+func (r *Rewrite) cookie(value string, upstreamHosts []string) string {
+	attributes := strings.Split(value, ";")
+	for i, attribute := range attributes[1:] {
+		j := strings.IndexByte(attribute, '=')
+		if j < 0 {
+			continue
+		}
+		name, attributeValue := strings.TrimSpace(attribute[:j]), strings.TrimSpace(attribute[j+1:])
+
+		switch strings.ToLower(name) {
+		case "domain":
+			if containsFold(upstreamHosts, strings.TrimPrefix(attributeValue, ".")) {
+				attributes[i+1] = " " + name + "=" + hostname(r.Host)
+			}
+		case "path":
+			if strings.HasPrefix(attributeValue, "/") {
+				attributes[i+1] = " " + name + "=" + r.path(attributeValue)
+			}
+		}
+	}
+	return strings.Join(attributes, ";")
+}
+
+// hostname gets a host without its port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if v != "" && strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// withSlash adds a trailing slash to a path prefix if it doesn't have one.
+func withSlash(prefix string) string {
+	if strings.HasSuffix(prefix, "/") {
+		return prefix
+	}
+	return prefix + "/"
+}
@@ -0,0 +1,54 @@
+package httpwrapper
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteResponse(t *testing.T) {
+	static := &Rewrite{Host: "www.cats.com", Prefix: "/", UpstreamPrefix: "/static/cats"}
+	service := &Rewrite{Host: "www.cats.com", Prefix: "/api", UpstreamPrefix: "/"}
+
+	tests := []struct {
+		rewrite       *Rewrite
+		header, value string
+		expected      string
+	}{
+		// Static routes map the static directory back to the root.
+		{static, "Location", "/static/cats/tabby/", "/tabby/"},
+		{static, "Location", "/static/cats", "/"},
+		{static, "Location", "http://s3.internal/static/cats/tabby?a=b", "/tabby?a=b"},
+		{static, "Location", "https://www.cats.com/static/cats/tabby", "https://www.cats.com/tabby"},
+		{static, "Location", "https://elsewhere.com/static/cats/tabby", "https://elsewhere.com/static/cats/tabby"},
+		{static, "Content-Location", "/static/cats/tabby.json", "/tabby.json"},
+		{static, "Refresh", "5; url=/static/cats/next", "5; url=/next"},
+		{static, "Refresh", "0;URL='http://s3.internal/static/cats/next'", "0;URL='/next'"},
+		{static, "Refresh", "30", "30"},
+
+		// Services mounted at a prefix get it added back.
+		{service, "Location", "/login", "/api/login"},
+		{service, "Location", "http://cats.default.svc.cluster.local:8080/login#top", "/api/login#top"},
+		{service, "Location", "login", "login"},
+		{service, "Location", "mailto:cats@cats.com", "mailto:cats@cats.com"},
+		{service, "Set-Cookie", "session=1; Path=/; Domain=cats.default.svc.cluster.local; HttpOnly", "session=1; Path=/api/; Domain=www.cats.com; HttpOnly"},
+		{service, "Set-Cookie", "session=1; path=/account; domain=.cats.com", "session=1; path=/api/account; domain=.cats.com"},
+
+		// Nothing is rewritten without a mapping.
+		{nil, "Location", "http://cats.default.svc.cluster.local/login", "http://cats.default.svc.cluster.local/login"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://cats.default.svc.cluster.local:8080/", nil)
+		if test.rewrite == static {
+			req, _ = http.NewRequest("GET", "http://s3.internal/static/cats/", nil)
+		}
+
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set(test.header, test.value)
+		test.rewrite.Response(resp, req)
+
+		if got := resp.Header.Get(test.header); got != test.expected {
+			t.Errorf("%s %q: expected %q, got %q", test.header, test.value, test.expected, got)
+		}
+	}
+}
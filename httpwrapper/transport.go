@@ -1,143 +1,56 @@
 package httpwrapper
 
-// An HTTP client which rate limits requests to application back-ends
-// and compresses responses.
+// An HTTP client which rate limits requests to application back-ends, and
+// decodes gzip responses for clients which can't.
 
 import (
-	"compress/gzip"
+	"fmt"
 	"io"
-	log "github.com/Sirupsen/logrus"
 	"net/http"
-	"strings"
 	"sync"
-)
+	"time"
 
-const (
-	MTUSize = 1000
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/accesslog"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/tracing"
 )
 
 var (
-	compressableTypes = []string{
-		"application/atom+xml",
-		"application/javascript",
-		"application/json",
-		"application/rss+xml",
-		"application/vnd.ms-fontobject",
-		"application/x-font-ttf",
-		"application/x-web-app-manifest+json",
-		"application/xhtml+xml",
-		"application/xml",
-		"font/opentype",
-		"image/svg+xml",
-		"image/x-icon",
-		"text/css",
-		"text/plain",
-		"text/x-component",
-	}
 	nothing = struct{}{}
 )
 
 type readCloserSem struct {
 	io.ReadCloser
-	sem chan struct{}
+	sem     chan struct{}
+	host    string
+	metrics metrics.Metrics
 }
 
 func (c *readCloserSem) Close() error {
 	err := c.ReadCloser.Close()
-	<-c.sem
+	release(c.sem, c.host, c.metrics)
 	return err
 }
 
+// release frees a slot in a host's semaphore.
+func release(sem chan struct{}, host string, m metrics.Metrics) {
+	<-sem
+	m.Gauge("semaphore_in_use", float64(len(sem)), []string{"upstream:" + host})
+}
+
 type Transport struct {
-	Transport                               http.RoundTripper
-	MaxConcurrencyPerHost, CompressionLevel int
+	Transport             http.RoundTripper
+	MaxConcurrencyPerHost int
+
+	// Metrics, if set, receives the semaphore, upstream and decompression
+	// metrics.
+	Metrics metrics.Metrics
 
 	// Unexported attributes.
 	mu  sync.Mutex
 	sem map[string]chan struct{}
 }
 
-func closeLogError(c io.Closer) {
-	if err := c.Close(); err != nil {
-		log.Errorln(err)
-	}
-}
-
-func compressResponse(resp *http.Response, compressionLevel int) error {
-
-	// Establish a new pipe.
-	pipeReader, pipeWriter := io.Pipe()
-
-	// In a seperate Go routine, compress the request body and copy it to the
-	// pipe.
-	go func(r io.ReadCloser) {
-
-		// Defer the closing of both the reader and writer.
-		defer closeLogError(r)
-		defer closeLogError(pipeWriter)
-
-		// Create a new gzip writer, wrapping the original writer,
-		// and defer its closing.
-		gzipWriter, err := gzip.NewWriterLevel(pipeWriter, compressionLevel)
-		if err != nil {
-			log.Errorln(err)
-			return
-		}
-		defer closeLogError(gzipWriter)
-
-		// Copy the response body to the gzip writer.
-		if _, err := io.Copy(gzipWriter, r); err != nil {
-			log.Errorln(err)
-		}
-	}(resp.Body)
-
-	resp.Header.Set("content-encoding", "gzip")
-	resp.Header.Del("content-length")
-	resp.Body = pipeReader
-	return nil
-}
-
-func compressionEnabledRequest(req *http.Request) bool {
-
-	// Check if the request defines the Accept-Encoding header.
-	requestAcceptEncoding := req.Header.Get("accept-encoding")
-	if requestAcceptEncoding == "" {
-		return false
-	}
-
-	// Check if the list of accepted encodings includes gzip.
-	return strings.Contains(requestAcceptEncoding, "gzip")
-}
-
-func compressableResponse(resp *http.Response) bool {
-
-	// Check if content length was defined. If it is and its value is lower than
-	// the MTU size, this isn't something we should try and compress.
-	if resp.ContentLength >= 0 && resp.ContentLength < MTUSize {
-		return false
-	}
-
-	// Check if the content has already been gzipped.
-	responseEncoding := resp.Header.Get("content-encoding")
-	if responseEncoding != "" && strings.Contains(responseEncoding, "gzip") {
-		return false
-	}
-
-	// Check if a response type has been defined.
-	responseType := resp.Header.Get("content-type")
-	if responseType == "" {
-		return false
-	}
-
-	// Then look through the list.
-	for _, compressableType := range compressableTypes {
-		if strings.Contains(responseType, compressableType) {
-			return true
-		}
-	}
-	return false
-}
-
 // Get the semaphore.
 func (t *Transport) getSem(req *http.Request) chan struct{} {
 	t.mu.Lock()
@@ -157,57 +70,99 @@ func (t *Transport) getSem(req *http.Request) chan struct{} {
 	return sem
 }
 
+// requestTags gets the tags added to the metrics for a request: the host it
+// was made to and the prefix of the route it matched.
+func requestTags(req *http.Request, tags ...string) []string {
+	if entry := accesslog.GetEntry(req); entry != nil {
+		tags = append(tags, "host:"+entry.HostTag(), "route:"+entry.Prefix)
+	}
+	return tags
+}
+
+// countVariantResponse counts upstream responses by status class for requests
+// to a route that splits traffic, so that the variants can be compared.
+func countVariantResponse(req *http.Request, status string, m metrics.Metrics) {
+	if entry := accesslog.GetEntry(req); entry != nil && entry.Variant != "" {
+		m.Count("variant_response", 1, []string{"variant:" + entry.Variant, "status:" + status})
+	}
+}
+
 // Wraps the HTTP request with a semaphore to rate limit requests.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := metrics.OrNop(t.Metrics)
+
+	span := tracing.FromRequest(req)
 
 	// Get the sem for this request and try to aquire it.
 	var sem chan struct{}
 	if t.MaxConcurrencyPerHost > 0 {
 		sem = t.getSem(req)
+		waitSpan := span.Child("semaphore_wait", tracing.Internal)
+		waitStart := time.Now()
 		sem <- nothing
+		wait := time.Since(waitStart)
+		waitSpan.End()
+		m.Gauge("semaphore_in_use", float64(len(sem)), []string{"upstream:" + req.URL.Host})
+		accesslog.GetEntry(req).SetSemaphoreWait(wait)
+		m.Timing("semaphore_wait", wait, requestTags(req, "upstream:"+req.URL.Host))
 	}
 
-	// Make the request.
+	// Make the request, passing the trace on to the upstream.
+	upstreamSpan := span.Child("upstream", tracing.Client)
+	upstreamSpan.SetAttribute("server.address", req.URL.Host)
+	upstreamSpan.Inject(req.Header)
+	start := time.Now()
 	resp, err := t.Transport.RoundTrip(req)
 	if err != nil {
+		upstreamSpan.SetError(err.Error())
+		upstreamSpan.End()
 
 		// Check if we need to release the sem.
 		if t.MaxConcurrencyPerHost > 0 {
-			<-sem
+			release(sem, req.URL.Host, m)
 		}
 
+		countVariantResponse(req, "error", m)
+
 		// Return the error.
 		return nil, err
 	}
 
-	// if this is a static request (i.e. req.URL matches static host and path)
-	// then gsub 'static-root' out of Location. (from d.Service(req.Host, req.URL.Path))
-	staticRoot := req.Header.Get("x-static-root")
-	s3Location := resp.Header.Get("Location")
-	s3Refresh := resp.Header.Get("Refresh")
-	if staticRoot != "" {
-		if s3Location != "" {
-			resp.Header.Set("Location", strings.Replace(s3Location, staticRoot, "/", 1))
-			log.Debugln("Location translated:", resp.Header.Get("Location"))
-		} else if s3Refresh != "" {
-			resp.Header.Set("Refresh", strings.Replace(s3Refresh, staticRoot, "/", 1))
-			log.Debugln("Refresh translated:", resp.Header.Get("Refresh"))
-		}
+	upstreamDuration := time.Since(start)
+	upstreamSpan.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		upstreamSpan.SetError(resp.Status)
+	}
+	upstreamSpan.End()
+	accesslog.GetEntry(req).SetUpstream(req.URL.Host, resp.StatusCode, upstreamDuration)
+	m.Timing("upstream_duration", upstreamDuration, requestTags(req, "upstream:"+req.URL.Host))
+	countVariantResponse(req, fmt.Sprintf("%dxx", resp.StatusCode/100), m)
+
+	// Map URLs in the response headers from the upstream's view back to the
+	// client's.
+	rewriteFrom(req).Response(resp, req)
+
+	// Set a few debug headers, if they were asked for.
+	if debug(req) {
+		resp.Header.Set("x-kubernetes-url", req.URL.String())
 	}
-
-	// Set a few debug headers.
-	resp.Header.Set("x-kubernetes-url", req.URL.String())
 
 	// Set up a sem release linked to the response being read.
 	if t.MaxConcurrencyPerHost > 0 {
-		resp.Body = &readCloserSem{resp.Body, sem}
+		resp.Body = &readCloserSem{resp.Body, sem, req.URL.Host, m}
 	}
 
-	// Check if we should compress the response.
-	if t.CompressionLevel > 0 && compressionEnabledRequest(req) && compressableResponse(resp) {
-		if err := compressResponse(resp, t.CompressionLevel); err != nil {
+	// Some upstreams send gzip whatever the client asked for, e.g. files
+	// stored compressed. Clients that don't accept it get it decoded.
+	if decompressable(req, resp) {
+		decoded, err := decompressResponse(req, resp)
+		if err != nil {
+			resp.Body.Close()
 			return nil, err
 		}
+		if decoded {
+			m.Count("decompressed_responses", 1, requestTags(req))
+		}
 	}
 
 	return resp, nil
@@ -1,18 +1,40 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"os"
 	log "github.com/Sirupsen/logrus"
+	"os"
 
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/accesslog"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/datadog"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/httpwrapper"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/redirectmap"
 	"github.com/newsdev/kubernetes-dns-reverse-proxy/router"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/tracing"
 )
 
-var config router.Config
+var (
+	config             router.Config
+	redirectMapsRaw    string
+	redirectMapsReload time.Duration
+	shutdownTimeout    time.Duration
+
+	statsdAddress, metricsNamespace, metricsTagsRaw string
+	metricsMaxTagValues                             int
+
+	otlpEndpoint, traceServiceName, tracePropagation string
+	traceSampleRate                                  float64
+	otlpInterval                                     time.Duration
+)
 
 func init() {
 	// Define flags for the router config object.
@@ -30,15 +52,76 @@ func init() {
 	flag.StringVar(&config.Fallback.Host, "fallback-host", "", "fallback host")
 	flag.StringVar(&config.Fallback.Path, "fallback-path", "/", "fallback path")
 	flag.StringVar(&config.RoutesFilename, "routes", "", "path to a routes file")
+	flag.DurationVar(&config.RoutesReload, "routes-reload", 0, "interval to check the routes file for changes (0 to disable)")
+	flag.StringVar(&redirectMapsRaw, "redirect-maps", "", "comma separated host=filename pairs of redirect map files (CSV or JSON lines)")
+	flag.DurationVar(&redirectMapsReload, "redirect-maps-reload", 0, "interval to check redirect map files for changes (0 to disable)")
 	flag.BoolVar(&config.ValidateRoutes, "validate-routes", false, "validate routes file and exit")
 	flag.IntVar(&config.Concurrency, "concurrency", 32, "concurrency per host")
 	flag.IntVar(&config.CompressionLevel, "compression-level", 4, "gzip compression level (0 to disable)")
+	flag.IntVar(&config.BrotliLevel, "brotli-level", 0, "brotli compression level, 1 to 11 (0 to disable)")
+	flag.IntVar(&config.ZstdLevel, "zstd-level", 0, "zstd compression level, 1 to 22 (0 to disable)")
+	flag.StringVar(&config.Compression.TypesRaw, "compress-types", strings.Join(httpwrapper.DefaultCompressibleTypes, ","), "comma separated media types to compress, which may have wildcard subtypes, e.g. text/*")
+	flag.Int64Var(&config.Compression.MinSize, "compress-min-size", httpwrapper.DefaultMinCompressSize, "smallest response in bytes to compress, if its length is known")
+	flag.BoolVar(&config.Compression.OptIn, "compress-opt-in", false, "only compress responses for routes with \"compress\": true")
+	flag.BoolVar(&config.Compression.Recompress, "recompress", false, "compress gzip responses decoded for clients that don't accept gzip with a coding they do accept")
 	flag.DurationVar(&config.Timeout, "timeout", time.Second, "dial timeout")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "time allowed for requests in flight to finish on SIGINT or SIGTERM")
+	flag.IntVar(&config.Mirror.QueueSize, "mirror-queue-size", 256, "number of shadow requests to queue for mirrors before dropping them")
+	flag.IntVar(&config.Mirror.Workers, "mirror-workers", 8, "number of concurrent shadow requests to mirrors")
+	flag.Int64Var(&config.Mirror.MaxBody, "mirror-max-body", 1<<16, "largest request body in bytes to buffer for mirrors")
+	flag.DurationVar(&config.Mirror.Timeout, "mirror-timeout", 10*time.Second, "timeout for shadow requests to mirrors")
+	flag.StringVar(&config.AccessLog.Format, "access-log-format", "custom", "access log format: json, combined or custom")
+	flag.StringVar(&config.AccessLog.FieldsRaw, "access-log-fields", "", "comma separated list of fields in json access logs (default all)")
+	flag.StringVar(&config.AccessLog.RulesFilename, "access-log-rules", "", "path to a JSON file of per-host access log sampling, filtering and redaction rules")
+	flag.StringVar(&config.AccessLog.Sink.Output, "access-log-output", "stdout", "access log output: stdout, file:///path, syslog://[host:port], syslog+tcp://host:port, udp://host:port, unix:///path or unixgram:///path")
+	flag.Int64Var(&config.AccessLog.Sink.MaxSize, "access-log-max-size", 0, "rotate the access log file once it reaches this many bytes (0 disables)")
+	flag.DurationVar(&config.AccessLog.Sink.RotateInterval, "access-log-rotate-interval", 0, "rotate the access log file at this interval (0 disables)")
+	flag.IntVar(&config.AccessLog.Sink.MaxBackups, "access-log-max-backups", 0, "number of rotated access log files to keep (0 keeps all)")
+	flag.StringVar(&config.AccessLog.Sink.Tag, "access-log-syslog-tag", "kubernetes-dns-reverse-proxy", "syslog tag for the access log")
+	flag.IntVar(&config.AccessLog.BufferSize, "access-log-buffer", accesslog.DefaultBufferSize, "number of access log lines queued for the output")
+	flag.StringVar(&config.AccessLog.DropPolicy, "access-log-drop-policy", "newest", "which access log line to drop when the queue is full: newest, oldest or none")
+	flag.StringVar(&statsdAddress, "statsd-address", os.Getenv("DD_AGENT_SERVICE_HOST_PORT"), "host:port of a DataDog agent to send metrics to over statsd (default $DD_AGENT_SERVICE_HOST_PORT)")
+	flag.StringVar(&metricsNamespace, "metrics-namespace", "k8s_dns", "prefix for metric names")
+	flag.StringVar(&metricsTagsRaw, "metrics-tags", "", "comma separated key:value tags to add to every metric")
+	flag.IntVar(&metricsMaxTagValues, "metrics-max-tag-values", 500, "number of distinct values of each metric tag before further values are tagged \"other\" (0 for no limit)")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of an OpenTelemetry collector's OTLP/HTTP traces endpoint, e.g. http://collector:4318/v1/traces (empty disables tracing)")
+	flag.DurationVar(&otlpInterval, "otlp-interval", tracing.DefaultOTLPInterval, "interval to send batches of spans to the collector")
+	flag.StringVar(&traceServiceName, "trace-service-name", "kubernetes-dns-reverse-proxy", "service name of the proxy's spans")
+	flag.Float64Var(&traceSampleRate, "trace-sample-rate", 0.01, "fraction of new traces to sample; requests with a sampling decision keep it")
+	flag.StringVar(&tracePropagation, "trace-propagation", "tracecontext,b3", "comma separated trace context formats to read and forward: tracecontext, b3")
+	flag.StringVar(&config.TrustedProxiesRaw, "trusted-proxies", "", "comma separated CIDRs or IP addresses of proxies trusted to set X-Forwarded-For and related headers")
+	flag.BoolVar(&config.ProxyProtocol.Enable, "proxy-protocol", false, "read PROXY protocol headers on the main listener from --proxy-protocol-trusted sources")
+	flag.StringVar(&config.ProxyProtocol.TrustedRaw, "proxy-protocol-trusted", "", "comma separated CIDRs or IP addresses of load balancers allowed to send PROXY protocol headers")
+	flag.DurationVar(&config.ProxyProtocol.Timeout, "proxy-protocol-timeout", 5*time.Second, "time allowed to read a PROXY protocol header")
+	flag.BoolVar(&config.Debug.Headers, "debug-headers", false, "add debug headers, like x-kubernetes-url, to every response")
+	flag.StringVar(&config.Debug.Secret, "debug-secret", os.Getenv("DEBUG_SECRET"), "secret signing X-Proxy-Debug request headers that ask for debug headers (default $DEBUG_SECRET)")
+	flag.DurationVar(&config.Debug.MaxTokenLifetime, "debug-token-max-lifetime", router.DefaultDebugTokenLifetime, "longest time before expiry that an X-Proxy-Debug token is accepted")
 	flag.BoolVar(&config.Verbose, "verbose", false, "verbose logging")
 
 	log.SetOutput(os.Stdout)
 }
 
+// metricsTags gets the tags added to every metric: those given by flag, the
+// pod's hostname and, for compatibility, the ENVIRONMENT variable.
+func metricsTags() []string {
+	var tags []string
+	if metricsTagsRaw != "" {
+		tags = strings.Split(metricsTagsRaw, ",")
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		tags = append(tags, "pod:"+hostname)
+	}
+	if environment := os.Getenv("ENVIRONMENT"); environment != "" {
+		tags = append(tags, "environment:"+environment)
+	}
+	return tags
+}
+
+// sanitizeNamespace turns a statsd namespace into a Prometheus one.
+func sanitizeNamespace(namespace string) string {
+	return strings.Replace(namespace, ".", "_", -1)
+}
+
 func main() {
 	// Parse command-line flags into the router config object.
 	flag.Parse()
@@ -48,6 +131,52 @@ func main() {
 		log.Debugln("verbose mode: now seeing debug logs")
 	}
 
+	// Metrics are kept for Prometheus to scrape, and go to DataDog too if
+	// an agent is configured.
+	prometheus := metrics.NewPrometheus(sanitizeNamespace(metricsNamespace) + "_")
+	prometheus.Buckets("compression_ratio", metrics.RatioBuckets...)
+	config.Metrics = prometheus
+
+	if statsdAddress != "" {
+		client, err := datadog.New(statsdAddress, metricsNamespace+".")
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infoln("Sending metrics to statsd at", statsdAddress)
+		config.Metrics = metrics.Multi(client, prometheus)
+	}
+
+	// Limit the values of the tags set per request before the default tags
+	// are added.
+	config.Metrics = metrics.WithTags(config.Metrics, metricsTags()...)
+	if metricsMaxTagValues > 0 {
+		config.Metrics = metrics.LimitTags(config.Metrics, metricsMaxTagValues)
+	}
+
+	var exporter *tracing.OTLPExporter
+	if otlpEndpoint != "" {
+		exporter = tracing.NewOTLPExporter(otlpEndpoint, traceServiceName, otlpInterval)
+		tracer, err := tracing.NewTracer(tracing.Config{
+			SampleRate:  traceSampleRate,
+			Propagation: strings.Split(tracePropagation, ","),
+			Exporter:    exporter,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Tracer = tracer
+		log.Infoln("Sending traces to", otlpEndpoint)
+	}
+
+	if redirectMapsRaw != "" {
+		redirectMaps, err := redirectmap.LoadMaps(redirectMapsRaw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		redirectMaps.Metrics = config.Metrics
+		config.RedirectMaps = redirectMaps
+	}
+
 	mainServer, err := router.NewKubernetesRouter(&config)
 	if err != nil {
 		log.Fatal(err)
@@ -58,19 +187,54 @@ func main() {
 		return
 	}
 
+	statusMux := http.NewServeMux()
+	statusMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	})
+	statusMux.Handle("/metrics", prometheus)
+
+	if config.RedirectMaps != nil {
+		statusMux.Handle("/redirect-maps", config.RedirectMaps)
+		if redirectMapsReload > 0 {
+			go config.RedirectMaps.Watch(redirectMapsReload, nil)
+		}
+	}
+
 	statusServer := &http.Server{
-		Addr: config.StatusAddress,
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			fmt.Fprintf(w, "ok")
-		}),
+		Addr:    config.StatusAddress,
+		Handler: statusMux,
 	}
 
 	// Each server could return a fatal error, so make a channel to signal on.
 	errs := make(chan error)
 
+	mainListener, err := router.Listen(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	go func() {
 		log.Infoln("starting server on", config.Address)
-		errs <- mainServer.ListenAndServe()
+		if err := mainServer.Serve(mainListener); err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+
+	// On SIGINT or SIGTERM, let requests in flight finish and write out the
+	// access log and queued spans before exiting.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Infoln("shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := mainServer.Shutdown(ctx)
+		if exporter != nil {
+			exporter.Close()
+		}
+		errs <- err
 	}()
 
 	go func() {
@@ -78,6 +242,9 @@ func main() {
 		errs <- statusServer.ListenAndServe()
 	}()
 
-	// Any error is fatal, so we only need to listen for the first one.
-	log.Fatal(<-errs)
+	// Any error is fatal, so we only need to listen for the first one. A
+	// clean shutdown sends nil.
+	if err := <-errs; err != nil {
+		log.Fatal(err)
+	}
 }
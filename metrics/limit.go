@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Other replaces tag values over a limit.
+const Other = "other"
+
+type limited struct {
+	m   Metrics
+	max int
+
+	mu     sync.Mutex
+	values map[string]map[string]struct{}
+}
+
+// LimitTags sends metrics to m, keeping at most max distinct values for each
+// tag key. Values seen after a key reaches the limit are replaced with Other,
+// so that a flood of unusual requests can't create an unbounded number of
+// series.
+func LimitTags(m Metrics, max int) Metrics {
+	return &limited{
+		m:      m,
+		max:    max,
+		values: make(map[string]map[string]struct{}),
+	}
+}
+
+// limit gets tags with any values over the limit replaced.
+func (l *limited) limit(tags []string) []string {
+	if len(tags) == 0 {
+		return tags
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var limitedTags []string
+	for i, tag := range tags {
+		j := strings.Index(tag, ":")
+		if j < 0 {
+			continue
+		}
+		key, value := tag[:j], tag[j+1:]
+
+		values, ok := l.values[key]
+		if !ok {
+			values = make(map[string]struct{})
+			l.values[key] = values
+		}
+
+		if _, ok := values[value]; ok {
+			continue
+		}
+		if len(values) < l.max {
+			values[value] = struct{}{}
+			continue
+		}
+
+		// Copy the tags before changing them, as they belong to the caller.
+		if limitedTags == nil {
+			limitedTags = append([]string(nil), tags...)
+		}
+		limitedTags[i] = key + ":" + Other
+	}
+
+	if limitedTags == nil {
+		return tags
+	}
+	return limitedTags
+}
+
+func (l *limited) Count(name string, value int64, tags []string) {
+	l.m.Count(name, value, l.limit(tags))
+}
+
+func (l *limited) Gauge(name string, value float64, tags []string) {
+	l.m.Gauge(name, value, l.limit(tags))
+}
+
+func (l *limited) Histogram(name string, value float64, tags []string) {
+	l.m.Histogram(name, value, l.limit(tags))
+}
+
+func (l *limited) Timing(name string, value time.Duration, tags []string) {
+	l.m.Timing(name, value, l.limit(tags))
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps metrics in memory for tests to check. Metrics are looked up by
+// name and tags, in any order.
+type Memory struct {
+	mu           sync.Mutex
+	counts       map[string]int64
+	gauges       map[string]float64
+	observations map[string][]float64
+}
+
+// NewMemory creates an empty set of metrics.
+func NewMemory() *Memory {
+	return &Memory{
+		counts:       make(map[string]int64),
+		gauges:       make(map[string]float64),
+		observations: make(map[string][]float64),
+	}
+}
+
+// key identifies a metric by its name and sorted tags.
+func key(name string, tags []string) string {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	return name + "|" + strings.Join(sorted, ",")
+}
+
+func (m *Memory) Count(name string, value int64, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[key(name, tags)] += value
+}
+
+func (m *Memory) Gauge(name string, value float64, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[key(name, tags)] = value
+}
+
+func (m *Memory) Histogram(name string, value float64, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key(name, tags)
+	m.observations[k] = append(m.observations[k], value)
+}
+
+// Timing records a duration in seconds, to be read with Observations.
+func (m *Memory) Timing(name string, value time.Duration, tags []string) {
+	m.Histogram(name, value.Seconds(), tags)
+}
+
+// Counter gets the total of a counter.
+func (m *Memory) Counter(name string, tags ...string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[key(name, tags)]
+}
+
+// GaugeValue gets the current value of a gauge.
+func (m *Memory) GaugeValue(name string, tags ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gauges[key(name, tags)]
+}
+
+// Observations gets the values recorded in a histogram or timing.
+func (m *Memory) Observations(name string, tags ...string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float64(nil), m.observations[key(name, tags)]...)
+}
@@ -0,0 +1,101 @@
+// Package metrics defines the interface the proxy sends metrics through, so
+// that they can go to statsd, Prometheus or both at once.
+package metrics
+
+import "time"
+
+// Metrics is a destination for metrics. Tags are given in key:value form.
+type Metrics interface {
+	// Count adds value to a counter.
+	Count(name string, value int64, tags []string)
+
+	// Gauge sets the current value of a gauge.
+	Gauge(name string, value float64, tags []string)
+
+	// Histogram records a value in a distribution.
+	Histogram(name string, value float64, tags []string)
+
+	// Timing records a duration in a distribution.
+	Timing(name string, value time.Duration, tags []string)
+}
+
+// Nop discards metrics.
+type Nop struct{}
+
+func (Nop) Count(name string, value int64, tags []string)          {}
+func (Nop) Gauge(name string, value float64, tags []string)        {}
+func (Nop) Histogram(name string, value float64, tags []string)    {}
+func (Nop) Timing(name string, value time.Duration, tags []string) {}
+
+// OrNop gets m, or Nop if m is nil, so that metrics can be left unconfigured.
+func OrNop(m Metrics) Metrics {
+	if m == nil {
+		return Nop{}
+	}
+	return m
+}
+
+type multi []Metrics
+
+// Multi sends metrics to each of m.
+func Multi(m ...Metrics) Metrics {
+	return multi(m)
+}
+
+func (m multi) Count(name string, value int64, tags []string) {
+	for _, metrics := range m {
+		metrics.Count(name, value, tags)
+	}
+}
+
+func (m multi) Gauge(name string, value float64, tags []string) {
+	for _, metrics := range m {
+		metrics.Gauge(name, value, tags)
+	}
+}
+
+func (m multi) Histogram(name string, value float64, tags []string) {
+	for _, metrics := range m {
+		metrics.Histogram(name, value, tags)
+	}
+}
+
+func (m multi) Timing(name string, value time.Duration, tags []string) {
+	for _, metrics := range m {
+		metrics.Timing(name, value, tags)
+	}
+}
+
+type tagged struct {
+	m    Metrics
+	tags []string
+}
+
+// WithTags sends metrics to m with tags added to every one.
+func WithTags(m Metrics, tags ...string) Metrics {
+	if len(tags) == 0 {
+		return m
+	}
+	return &tagged{m, tags}
+}
+
+func (t *tagged) with(tags []string) []string {
+	all := make([]string, 0, len(t.tags)+len(tags))
+	return append(append(all, t.tags...), tags...)
+}
+
+func (t *tagged) Count(name string, value int64, tags []string) {
+	t.m.Count(name, value, t.with(tags))
+}
+
+func (t *tagged) Gauge(name string, value float64, tags []string) {
+	t.m.Gauge(name, value, t.with(tags))
+}
+
+func (t *tagged) Histogram(name string, value float64, tags []string) {
+	t.m.Histogram(name, value, t.with(tags))
+}
+
+func (t *tagged) Timing(name string, value time.Duration, tags []string) {
+	t.m.Timing(name, value, t.with(tags))
+}
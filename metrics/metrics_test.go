@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithTags(t *testing.T) {
+	m := NewMemory()
+	tagged := WithTags(m, "pod:proxy-1")
+
+	tagged.Count("requests", 1, []string{"host:www.example.com"})
+	tagged.Count("requests", 1, []string{"host:www.example.com"})
+	tagged.Gauge("requests_in_flight", 4, nil)
+	tagged.Timing("request_duration", 250*time.Millisecond, nil)
+
+	if count := m.Counter("requests", "host:www.example.com", "pod:proxy-1"); count != 2 {
+		t.Errorf("expected a count of 2, got %d", count)
+	}
+	if value := m.GaugeValue("requests_in_flight", "pod:proxy-1"); value != 4 {
+		t.Errorf("expected a gauge of 4, got %v", value)
+	}
+	if observations := m.Observations("request_duration", "pod:proxy-1"); len(observations) != 1 || observations[0] != .25 {
+		t.Errorf("expected a timing of 0.25s, got %v", observations)
+	}
+	if count := m.Counter("requests", "host:www.example.com"); count != 0 {
+		t.Errorf("expected no count without the default tag, got %d", count)
+	}
+
+	// Nop and unconfigured metrics accept anything.
+	OrNop(nil).Count("requests", 1, nil)
+}
+
+func TestLimitTags(t *testing.T) {
+	m := NewMemory()
+	limited := LimitTags(m, 2)
+
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com", "a.example.com", "d.example.com"} {
+		limited.Count("requests", 1, []string{"host:" + host, "status_class:2xx"})
+	}
+
+	for _, test := range []struct {
+		host  string
+		count int64
+	}{
+		{"a.example.com", 2},
+		{"b.example.com", 1},
+		{"c.example.com", 0},
+		{Other, 2},
+	} {
+		if count := m.Counter("requests", "host:"+test.host, "status_class:2xx"); count != test.count {
+			t.Errorf("expected a count of %d for %s, got %d", test.count, test.host, count)
+		}
+	}
+}
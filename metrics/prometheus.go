@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultBuckets are the upper bounds of histogram buckets, in seconds
+	// for timings.
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// RatioBuckets suit histograms of values between 0 and 1.
+	RatioBuckets = []float64{.1, .2, .3, .4, .5, .6, .7, .8, .9, 1}
+)
+
+// Prometheus keeps metrics in memory and serves them in the Prometheus text
+// exposition format. Counts are exposed as counters with a _total suffix and
+// timings as histograms in seconds with a _seconds suffix. Tags become labels,
+// and tags without a colon are ignored.
+type Prometheus struct {
+	namespace string
+
+	mu       sync.Mutex
+	buckets  map[string][]float64
+	families map[string]*family
+}
+
+type family struct {
+	kind   string
+	series map[string]*series
+}
+
+type series struct {
+	labels string
+	value  float64
+
+	// Histograms only.
+	bounds []float64
+	counts []uint64
+	count  uint64
+}
+
+// NewPrometheus creates an empty set of metrics, with names prefixed by
+// namespace.
+func NewPrometheus(namespace string) *Prometheus {
+	return &Prometheus{
+		namespace: namespace,
+		buckets:   make(map[string][]float64),
+		families:  make(map[string]*family),
+	}
+}
+
+// Buckets sets the upper bounds of the buckets of a histogram, in place of
+// DefaultBuckets. It must be called before the histogram is first recorded.
+func (p *Prometheus) Buckets(name string, bounds ...float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buckets[name] = bounds
+}
+
+func (p *Prometheus) Count(name string, value int64, tags []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.series("counter", name+"_total", tags, nil).value += float64(value)
+}
+
+func (p *Prometheus) Gauge(name string, value float64, tags []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.series("gauge", name, tags, nil).value = value
+}
+
+func (p *Prometheus) Histogram(name string, value float64, tags []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observe(name, name, value, tags)
+}
+
+func (p *Prometheus) Timing(name string, value time.Duration, tags []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observe(name, name+"_seconds", value.Seconds(), tags)
+}
+
+func (p *Prometheus) observe(name, fullName string, value float64, tags []string) {
+	bounds, ok := p.buckets[name]
+	if !ok {
+		bounds = DefaultBuckets
+	}
+
+	s := p.series("histogram", fullName, tags, bounds)
+	s.value += value
+	s.count++
+	for i, bound := range s.bounds {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+}
+
+// series gets a series, creating it if need be. p.mu must be held.
+func (p *Prometheus) series(kind, name string, tags []string, bounds []float64) *series {
+	name = sanitize(p.namespace + name)
+
+	f, ok := p.families[name]
+	if !ok {
+		f = &family{kind: kind, series: make(map[string]*series)}
+		p.families[name] = f
+	}
+
+	labels := formatLabels(tags)
+	s, ok := f.series[labels]
+	if !ok {
+		s = &series{labels: labels, bounds: bounds}
+		if bounds != nil {
+			s.counts = make([]uint64, len(bounds))
+		}
+		f.series[labels] = s
+	}
+	return s
+}
+
+// sanitize replaces the characters that aren't allowed in metric and label
+// names with underscores.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels turns key:value tags into sorted, comma separated labels.
+func formatLabels(tags []string) string {
+	labels := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		i := strings.Index(tag, ":")
+		if i < 0 {
+			continue
+		}
+		key := sanitize(tag[:i])
+		labels = append(labels, key+`="`+labelValueReplacer.Replace(tag[i+1:])+`"`)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeSample writes a line of the text format, adding extra to the labels.
+func writeSample(buf *bytes.Buffer, name, labels, extra, value string) {
+	buf.WriteString(name)
+	if labels != "" || extra != "" {
+		buf.WriteByte('{')
+		buf.WriteString(labels)
+		if labels != "" && extra != "" {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(extra)
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// WriteText writes the metrics in the text exposition format.
+func (p *Prometheus) WriteText(buf *bytes.Buffer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := p.families[name]
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for labels := range f.series {
+			keys = append(keys, labels)
+		}
+		sort.Strings(keys)
+
+		for _, labels := range keys {
+			s := f.series[labels]
+			if f.kind != "histogram" {
+				writeSample(buf, name, labels, "", formatFloat(s.value))
+				continue
+			}
+
+			for i, bound := range s.bounds {
+				writeSample(buf, name+"_bucket", labels, `le="`+formatFloat(bound)+`"`, strconv.FormatUint(s.counts[i], 10))
+			}
+			writeSample(buf, name+"_bucket", labels, `le="+Inf"`, strconv.FormatUint(s.count, 10))
+			writeSample(buf, name+"_sum", labels, "", formatFloat(s.value))
+			writeSample(buf, name+"_count", labels, "", strconv.FormatUint(s.count, 10))
+		}
+	}
+}
+
+// ServeHTTP serves the metrics in the text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	p.WriteText(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
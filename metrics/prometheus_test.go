@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus("test_")
+	p.Buckets("ratio", .5, 1)
+
+	p.Count("requests", 1, []string{"status_class:2xx", "host:www.example.com"})
+	p.Count("requests", 2, []string{"host:www.example.com", "status_class:2xx"})
+	p.Count("requests", 1, []string{"host:www.example.com", "status_class:5xx"})
+	p.Gauge("in-flight", 3, nil)
+	p.Gauge("in-flight", 2, nil)
+	p.Histogram("ratio", .25, []string{"path:\"quoted\""})
+	p.Histogram("ratio", .75, []string{"path:\"quoted\""})
+	p.Timing("duration", 20*time.Millisecond, []string{"untagged"})
+
+	var buf bytes.Buffer
+	p.WriteText(&buf)
+	expected := `# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.005"} 0
+test_duration_seconds_bucket{le="0.01"} 0
+test_duration_seconds_bucket{le="0.025"} 1
+test_duration_seconds_bucket{le="0.05"} 1
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="0.25"} 1
+test_duration_seconds_bucket{le="0.5"} 1
+test_duration_seconds_bucket{le="1"} 1
+test_duration_seconds_bucket{le="2.5"} 1
+test_duration_seconds_bucket{le="5"} 1
+test_duration_seconds_bucket{le="10"} 1
+test_duration_seconds_bucket{le="+Inf"} 1
+test_duration_seconds_sum 0.02
+test_duration_seconds_count 1
+# TYPE test_in_flight gauge
+test_in_flight 2
+# TYPE test_ratio histogram
+test_ratio_bucket{path="\"quoted\"",le="0.5"} 1
+test_ratio_bucket{path="\"quoted\"",le="1"} 2
+test_ratio_bucket{path="\"quoted\"",le="+Inf"} 2
+test_ratio_sum{path="\"quoted\""} 1
+test_ratio_count{path="\"quoted\""} 2
+# TYPE test_requests_total counter
+test_requests_total{host="www.example.com",status_class="2xx"} 3
+test_requests_total{host="www.example.com",status_class="5xx"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestMulti(t *testing.T) {
+	a, b := NewPrometheus(""), NewPrometheus("")
+	m := Multi(a, b)
+	m.Count("requests", 1, nil)
+
+	for _, p := range []*Prometheus{a, b} {
+		var buf bytes.Buffer
+		p.WriteText(&buf)
+		if !strings.Contains(buf.String(), "requests_total 1\n") {
+			t.Errorf("expected each destination to get the count, got\n%s", buf.String())
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package proxyproto reads PROXY protocol (version 1 or 2) headers sent by a
+// TCP load balancer, so that connections report the client's address rather
+// than the load balancer's.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/forwarded"
+)
+
+const (
+	// v1MaxLength is the length of the longest version 1 header, including
+	// the CRLF.
+	v1MaxLength = 107
+
+	v2HeaderLength = 16
+)
+
+var (
+	v1Signature = []byte("PROXY")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+// Listener reads PROXY protocol headers from connections accepted from
+// trusted sources. Connections from anywhere else are left as they are, so a
+// header sent by one of them is treated as part of the request.
+type Listener struct {
+	net.Listener
+
+	// Trusted are the networks of the load balancers allowed to send a header.
+	Trusted forwarded.Proxies
+
+	// Timeout limits how long reading the header may take. Zero means no
+	// limit.
+	Timeout time.Duration
+}
+
+// Accept accepts a connection. Its header is read on the first call to Read
+// or RemoteAddr, so that a slow client doesn't hold up the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	trusted := err == nil && l.Trusted.Contains(host)
+
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		trusted: trusted,
+		timeout: l.Timeout,
+	}, nil
+}
+
+// Conn is a connection that may start with a PROXY protocol header.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted bool
+	timeout time.Duration
+
+	once   sync.Once
+	source net.Addr
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if !c.trusted {
+			return
+		}
+
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.source, c.err = readHeader(c.reader)
+	})
+}
+
+// Read reads from the connection after the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr gets the client's address given by the header, if there was one.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads a header if the connection starts with one, getting the
+// source address it gives. The address is nil if there's no header, or if the
+// header doesn't describe a proxied TCP connection.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	switch first[0] {
+	case v1Signature[0]:
+		if b, err := r.Peek(len(v1Signature)); err == nil && bytes.Equal(b, v1Signature) {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		if b, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(b, v2Signature) {
+			return readV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readV1 reads a human readable header, e.g.
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, errInvalidHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, errInvalidHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errInvalidHeader
+	}
+
+	if len(fields) != 6 {
+		return nil, errInvalidHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+
+	switch versionCommand & 0xf {
+	case 0:
+		// LOCAL, e.g. a health check from the load balancer itself.
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, errInvalidHeader
+	}
+
+	// Only TCP over IPv4 or IPv6 gives an address to use. Anything after the
+	// addresses, e.g. TLVs, is skipped.
+	switch family {
+	case 0x11:
+		if length < 12 {
+			return nil, errInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		if length < 36 {
+			return nil, errInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
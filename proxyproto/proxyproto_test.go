@@ -0,0 +1,100 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/forwarded"
+)
+
+func v2Header(command, family byte, body []byte) string {
+	header := append([]byte(nil), v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(body)))
+	return string(append(header, body...))
+}
+
+func TestListener(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:34], 56324)
+
+	const request = "GET / HTTP/1.1\r\nHost: www.example.com\r\nConnection: close\r\n\r\n"
+
+	tests := []struct {
+		name, trusted, header string
+		status                int
+		remoteAddr            string
+	}{
+		{"v1 tcp4", "127.0.0.1", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", 200, "192.0.2.1:56324"},
+		{"v1 tcp6", "127.0.0.1", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", 200, "[2001:db8::1]:56324"},
+		{"v1 unknown", "127.0.0.1", "PROXY UNKNOWN\r\n", 200, "127.0.0.1"},
+		{"v2 ipv4", "127.0.0.0/8", v2Header(1, 0x11, ipv4), 200, "192.0.2.1:56324"},
+		{"v2 ipv6 with tlv", "127.0.0.0/8", v2Header(1, 0x21, append(ipv6, 0x04, 0, 1, 'x')), 200, "[2001:db8::1]:56324"},
+		{"v2 local", "127.0.0.1", v2Header(0, 0, nil), 200, "127.0.0.1"},
+		{"no header", "127.0.0.1", "", 200, "127.0.0.1"},
+		{"untrusted", "192.0.2.0/24", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", 400, ""},
+		{"v1 mismatched family", "127.0.0.1", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", 400, ""},
+		{"v1 no crlf", "127.0.0.1", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", 400, ""},
+		{"v2 short", "127.0.0.1", v2Header(1, 0x11, ipv4[:8]), 400, ""},
+	}
+
+	for _, test := range tests {
+		trusted, err := forwarded.ParseProxies(test.trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remoteAddrs := make(chan string, 1)
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				remoteAddrs <- req.RemoteAddr
+			}),
+		}
+		go server.Serve(&Listener{Listener: l, Trusted: trusted, Timeout: time.Second})
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(test.header + request)); err != nil {
+			t.Fatal(err)
+		}
+
+		status := 0
+		if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+			ioutil.ReadAll(resp.Body)
+			status = resp.StatusCode
+		}
+		conn.Close()
+		server.Close()
+
+		if status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+			continue
+		}
+		if status != 200 {
+			continue
+		}
+
+		remoteAddr := <-remoteAddrs
+		if test.remoteAddr == "127.0.0.1" {
+			remoteAddr = strings.Split(remoteAddr, ":")[0]
+		}
+		if remoteAddr != test.remoteAddr {
+			t.Errorf("%s: expected remote address %s, got %s", test.name, test.remoteAddr, remoteAddr)
+		}
+	}
+}
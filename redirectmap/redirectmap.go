@@ -0,0 +1,368 @@
+// Package redirectmap implements large exact-path redirect tables, loaded per
+// host from CSV or JSON lines files.
+package redirectmap
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+)
+
+// Entry is a single redirect from an exact path.
+type Entry struct {
+	// hits is updated atomically, so it comes first to keep it 64-bit aligned.
+	hits uint64
+
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status int    `json:"status,omitempty"`
+}
+
+// Hits gets the number of requests the entry has redirected.
+func (e *Entry) Hits() uint64 {
+	return atomic.LoadUint64(&e.hits)
+}
+
+// StatusCode gets the HTTP status code of the redirect, defaulting to 301.
+func (e *Entry) StatusCode() int {
+	if e.Status == 0 {
+		return http.StatusMovedPermanently
+	}
+	return e.Status
+}
+
+// Location gets the redirect destination for a request URL. The request's
+// query string is carried over unless the destination defines its own.
+func (e *Entry) Location(requestURL *url.URL) string {
+	if requestURL.RawQuery == "" || strings.Contains(e.To, "?") {
+		return e.To
+	}
+	return e.To + "?" + requestURL.RawQuery
+}
+
+func (e *Entry) validate() error {
+	if !strings.HasPrefix(e.From, "/") {
+		return fmt.Errorf("source path %q doesn't begin with /", e.From)
+	}
+
+	if e.To == "" {
+		return fmt.Errorf("%s: destination is empty", e.From)
+	}
+	if _, err := url.Parse(e.To); err != nil {
+		return fmt.Errorf("%s: %s", e.From, err)
+	}
+
+	switch e.StatusCode() {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("%s: unsupported redirect status %d", e.From, e.Status)
+	}
+	return nil
+}
+
+// Map is a redirect table for a single host, loaded from a file.
+type Map struct {
+	Filename string
+
+	mu      sync.RWMutex
+	entries map[string]*Entry
+	modTime time.Time
+	size    int64
+
+	// failedModTime and failedSize are those of the file when it last
+	// failed to load, so that it isn't read again until it changes.
+	failedModTime time.Time
+	failedSize    int64
+}
+
+// Load reads a redirect map from a file. Files with a .csv extension hold
+// "from,to[,status]" records; anything else is read as JSON lines of
+// {"from": ..., "to": ..., "status": ...} objects.
+func Load(filename string) (*Map, error) {
+	m := &Map{Filename: filename}
+	if _, err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the map's file again if it has been modified since it was last
+// loaded, reporting whether it was. The current table is kept if the file
+// can't be read or fails validation, and the file isn't read again until it
+// changes.
+func (m *Map) Reload() (bool, error) {
+	info, err := os.Stat(m.Filename)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.RLock()
+	unchanged := info.ModTime().Equal(m.modTime) && info.Size() == m.size ||
+		info.ModTime().Equal(m.failedModTime) && info.Size() == m.failedSize
+	m.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	entries, err := m.read()
+	if err != nil {
+		m.mu.Lock()
+		m.failedModTime = info.ModTime()
+		m.failedSize = info.Size()
+		m.mu.Unlock()
+		return false, fmt.Errorf("%s: %s", m.Filename, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Carry hit counts over for paths that are still in the map.
+	for path, entry := range m.entries {
+		if newEntry, ok := entries[path]; ok {
+			newEntry.hits = entry.Hits()
+		}
+	}
+
+	m.entries = entries
+	m.modTime = info.ModTime()
+	m.size = info.Size()
+	m.failedModTime = time.Time{}
+	m.failedSize = 0
+
+	return true, nil
+}
+
+// read parses the map's file.
+func (m *Map) read() (map[string]*Entry, error) {
+	file, err := os.Open(m.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(m.Filename), ".csv") {
+		return readCSV(file)
+	}
+	return readJSONLines(file)
+}
+
+// Len gets the number of entries in the map.
+func (m *Map) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.entries)
+}
+
+// Lookup finds the entry for an exact path, counting a hit if there is one.
+func (m *Map) Lookup(path string) (*Entry, bool) {
+	m.mu.RLock()
+	entry, ok := m.entries[path]
+	m.mu.RUnlock()
+
+	if ok {
+		atomic.AddUint64(&entry.hits, 1)
+	}
+	return entry, ok
+}
+
+// Hits gets the hit count of every entry that has been used, by source path.
+func (m *Map) Hits() map[string]uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hits := make(map[string]uint64)
+	for path, entry := range m.entries {
+		if n := entry.Hits(); n > 0 {
+			hits[path] = n
+		}
+	}
+	return hits
+}
+
+func addEntry(entries map[string]*Entry, entry *Entry, line int) error {
+	if err := entry.validate(); err != nil {
+		return fmt.Errorf("line %d: %s", line, err)
+	}
+	if _, ok := entries[entry.From]; ok {
+		return fmt.Errorf("line %d: duplicate source path %s", line, entry.From)
+	}
+	entries[entry.From] = entry
+	return nil
+}
+
+func readCSV(r io.Reader) (map[string]*Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	entries := make(map[string]*Entry)
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Allow an optional header row.
+		if first && len(record) > 0 && record[0] == "from" {
+			continue
+		}
+
+		// Records can follow comments or span lines with quoted fields, so
+		// errors give the line the record starts on in the file.
+		line, _ := reader.FieldPos(0)
+
+		if len(record) < 2 || len(record) > 3 {
+			return nil, fmt.Errorf("line %d: expected 2 or 3 fields, got %d", line, len(record))
+		}
+
+		entry := &Entry{From: record[0], To: record[1]}
+		if len(record) == 3 && record[2] != "" {
+			if entry.Status, err = strconv.Atoi(record[2]); err != nil {
+				statusLine, _ := reader.FieldPos(2)
+				return nil, fmt.Errorf("line %d: bad status %q", statusLine, record[2])
+			}
+		}
+
+		if err := addEntry(entries, entry, line); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func readJSONLines(r io.Reader) (map[string]*Entry, error) {
+	scanner := bufio.NewScanner(r)
+
+	entries := make(map[string]*Entry)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		entry := &Entry{}
+		if err := json.Unmarshal([]byte(text), entry); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		if err := addEntry(entries, entry, line); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Maps holds the redirect map of each host.
+type Maps struct {
+	hosts map[string]*Map
+
+	// Metrics, if set, counts reload results.
+	Metrics metrics.Metrics
+}
+
+// LoadMaps loads the redirect maps described by a comma separated list of
+// host=filename pairs.
+func LoadMaps(raw string) (*Maps, error) {
+	maps := &Maps{hosts: make(map[string]*Map)}
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("redirect map %q isn't in host=filename format", pair)
+		}
+
+		host, filename := pair[:i], pair[i+1:]
+		if _, ok := maps.hosts[host]; ok {
+			return nil, fmt.Errorf("more than one redirect map for %s", host)
+		}
+
+		m, err := Load(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infoln("Loaded redirect map:", host, filename, m.Len(), "entries")
+		maps.hosts[host] = m
+	}
+	return maps, nil
+}
+
+// Lookup finds the entry for a host and exact path.
+func (ms *Maps) Lookup(host, path string) (*Entry, bool) {
+	m, ok := ms.hosts[host]
+	if !ok {
+		return nil, false
+	}
+	return m.Lookup(path)
+}
+
+// Reload reloads every map whose file has changed. Errors are logged, and a map
+// that fails to reload keeps serving its previous table.
+func (ms *Maps) Reload() {
+	stats := metrics.OrNop(ms.Metrics)
+	for host, m := range ms.hosts {
+		reloaded, err := m.Reload()
+		if err != nil {
+			stats.Count("redirect_map_reload", 1, []string{"redirect_map:" + host, "result:error"})
+			log.Errorln("Error reloading redirect map:", host, err)
+			continue
+		}
+		if reloaded {
+			stats.Count("redirect_map_reload", 1, []string{"redirect_map:" + host, "result:success"})
+			log.Infoln("Reloaded redirect map:", host, m.Filename, m.Len(), "entries")
+		}
+	}
+}
+
+// Watch reloads changed maps every interval until stop is closed.
+func (ms *Maps) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ServeHTTP reports the hit counts of every map as JSON.
+func (ms *Maps) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hits := make(map[string]map[string]uint64)
+	for host, m := range ms.hosts {
+		hits[host] = m.Hits()
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(hits); err != nil {
+		log.Errorln(err)
+	}
+}
@@ -0,0 +1,179 @@
+package redirectmap
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+)
+
+func writeTempFile(t *testing.T, dir, name, contents string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redirectmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name, contents string
+		valid          bool
+	}{
+		{"valid.csv", "from,to,status\n/2012/cats.html,https://www.cats.com/cats\n/tmp,/new,302\n", true},
+		{"valid.jsonl", `{"from": "/2012/cats.html", "to": "https://www.cats.com/cats"}` + "\n\n" + `{"from": "/tmp", "to": "/new", "status": 302}`, true},
+		{"relative.csv", "2012/cats.html,https://www.cats.com/cats\n", false},
+		{"status.csv", "/tmp,/new,200\n", false},
+		{"fields.csv", "/tmp\n", false},
+		{"duplicate.csv", "/tmp,/new\n/tmp,/newer\n", false},
+		{"empty.jsonl", `{"from": "/tmp"}`, false},
+		{"broken.jsonl", `{"from": "/tmp",`, false},
+	}
+
+	// Errors give the line in the file, past headers, comments and quoted
+	// fields spanning lines.
+	for contents, expected := range map[string]string{
+		"from,to\n# cats\n/tmp,/new,200\n":          "line 3:",
+		"\"/cats\nand dogs\",/new\n/tmp,/new,200\n": "line 3:",
+		"/tmp,/new\n\n/old,/new,\"30\n1\"\n":        "line 3:",
+	} {
+		_, err := Load(writeTempFile(t, dir, "lines.csv", contents))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected an error on %s got %v", contents, expected, err)
+		}
+	}
+
+	for _, test := range tests {
+		m, err := Load(writeTempFile(t, dir, test.name, test.contents))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got error %v", test.name, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+
+		if m.Len() != 2 {
+			t.Errorf("%s: expected 2 entries, got %d", test.name, m.Len())
+		}
+
+		entry, ok := m.Lookup("/tmp")
+		if !ok {
+			t.Errorf("%s: expected an entry for /tmp", test.name)
+			continue
+		}
+		if entry.To != "/new" || entry.StatusCode() != 302 {
+			t.Errorf("%s: expected /tmp to redirect to /new with a 302, got %+v", test.name, entry)
+		}
+
+		entry, _ = m.Lookup("/2012/cats.html")
+		if entry.StatusCode() != 301 {
+			t.Errorf("%s: expected a default status of 301, got %d", test.name, entry.StatusCode())
+		}
+
+		if _, ok := m.Lookup("/2012"); ok {
+			t.Errorf("%s: expected no entry for a prefix of a path", test.name)
+		}
+	}
+}
+
+func TestMapsLookupAndReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redirectmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := writeTempFile(t, dir, "cats.csv", "/old,https://www.cats.com/new\n/gone,https://www.cats.com/\n")
+	maps, err := LoadMaps("www.cats.com=" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := metrics.NewMemory()
+	maps.Metrics = stats
+
+	if _, ok := maps.Lookup("www.dogs.com", "/old"); ok {
+		t.Error("expected no entry for a host without a map")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, ok := maps.Lookup("www.cats.com", "/old"); !ok {
+			t.Fatal("expected an entry for /old")
+		}
+	}
+
+	entry, _ := maps.Lookup("www.cats.com", "/gone")
+	requestURL, _ := url.Parse("/gone?a=1")
+	if location := entry.Location(requestURL); location != "https://www.cats.com/?a=1" {
+		t.Errorf("expected the query string to be carried over, got %s", location)
+	}
+
+	// Rewrite the file with a later modification time and reload it.
+	writeTempFile(t, dir, "cats.csv", "/old,https://www.cats.com/newer\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	maps.Reload()
+
+	entry, ok := maps.Lookup("www.cats.com", "/old")
+	if !ok || entry.To != "https://www.cats.com/newer" {
+		t.Fatalf("expected /old to be reloaded, got %+v", entry)
+	}
+	if _, ok := maps.Lookup("www.cats.com", "/gone"); ok {
+		t.Error("expected /gone to be removed on reload")
+	}
+
+	hits := maps.hosts["www.cats.com"].Hits()
+	if hits["/old"] != 4 {
+		t.Errorf("expected /old to have 4 hits carried over the reload, got %d", hits["/old"])
+	}
+
+	// A broken file keeps the previous table.
+	writeTempFile(t, dir, "cats.csv", "old,new\n")
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	maps.Reload()
+
+	if _, ok := maps.Lookup("www.cats.com", "/old"); !ok {
+		t.Error("expected a failed reload to keep the previous table")
+	}
+
+	// The broken file is only reported once, until it changes.
+	maps.Reload()
+	maps.Reload()
+	if count := stats.Counter("redirect_map_reload", "redirect_map:www.cats.com", "result:error"); count != 1 {
+		t.Errorf("expected a broken file to be reported once, got %d errors", count)
+	}
+
+	writeTempFile(t, dir, "cats.csv", "/old,https://www.cats.com/newest\n")
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	maps.Reload()
+
+	if entry, _ := maps.Lookup("www.cats.com", "/old"); entry == nil || entry.To != "https://www.cats.com/newest" {
+		t.Errorf("expected the fixed file to be loaded, got %+v", entry)
+	}
+	if count := stats.Counter("redirect_map_reload", "redirect_map:www.cats.com", "result:success"); count != 2 {
+		t.Errorf("expected 2 successful reloads, got %d", count)
+	}
+
+	if _, err := LoadMaps("www.cats.com"); err == nil {
+		t.Error("expected an error for a pair without a filename")
+	}
+}
@@ -0,0 +1,66 @@
+// Package requestid gives each request an ID, taken from the X-Request-ID
+// header if the client sent a valid one, so that a request can be followed
+// through the proxy's logs and the upstream's.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// Header is the header request IDs are read from and forwarded in.
+const Header = "X-Request-ID"
+
+// MaxLength is the length of the longest client-supplied ID accepted.
+const MaxLength = 128
+
+// Valid checks a client-supplied ID, which may only contain letters, digits,
+// and - _ . : characters, so that it can't break up a log line.
+func Valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// New generates a random (version 4) UUID.
+func New() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type idKey struct{}
+
+// FromRequest gets the ID of a request, or an empty string if it has none.
+func FromRequest(req *http.Request) string {
+	id, _ := req.Context().Value(idKey{}).(string)
+	return id
+}
+
+// Handler gives each request to h an ID, replacing a missing or invalid
+// X-Request-ID header. The ID is set in the request header, so that it's
+// forwarded upstream, in the response header, and in the request context for
+// FromRequest.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(Header)
+		if !Valid(id) {
+			id = New()
+			req.Header.Set(Header, id)
+		}
+
+		w.Header().Set(Header, id)
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), idKey{}, id)))
+	})
+}
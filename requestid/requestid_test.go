@@ -0,0 +1,64 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestValid(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"abc123":                                   true,
+		"f47ac10b-58cc-4372-a567-0e02b2c3d479":     true,
+		"Root=1-67891233-abcdef012345678912345678": false,
+		"trace:span.1_2":                           true,
+		"":                                         false,
+		"has space":                                false,
+		"quote\"d":                                 false,
+		"new\nline":                                false,
+		strings.Repeat("a", MaxLength):             true,
+		strings.Repeat("a", MaxLength+1):           false,
+	} {
+		if Valid(id) != valid {
+			t.Errorf("expected Valid(%q) to be %t", id, valid)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var forwarded, fromContext string
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Get(Header)
+		fromContext = FromRequest(req)
+	}))
+
+	for _, test := range []struct {
+		given string
+		kept  bool
+	}{
+		{"abc123", true},
+		{"", false},
+		{"<script>", false},
+	} {
+		req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+		if test.given != "" {
+			req.Header.Set(Header, test.given)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if test.kept && forwarded != test.given {
+			t.Errorf("expected %q to be kept, got %q", test.given, forwarded)
+		}
+		if !test.kept && !uuidPattern.MatchString(forwarded) {
+			t.Errorf("expected %q to be replaced with a UUID, got %q", test.given, forwarded)
+		}
+		if fromContext != forwarded || w.Header().Get(Header) != forwarded {
+			t.Errorf("expected the same ID upstream, in the context and in the response, got %q, %q and %q", forwarded, fromContext, w.Header().Get(Header))
+		}
+	}
+}
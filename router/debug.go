@@ -0,0 +1,67 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugHeader is the request header that asks for debug response headers. It
+// holds a token signed with the debug secret.
+const debugHeader = "X-Proxy-Debug"
+
+// internalHeaders are stripped from every request, so that clients can't send
+// them upstream. The x-static-root and x-original-url headers were once used
+// to pass routing details to the transport, and upstreams may still trust
+// them.
+var internalHeaders = []string{"X-Static-Root", "X-Original-Url", "X-Kubernetes-Url", debugHeader}
+
+// DebugToken gets a token for the debug header which is valid for requests to
+// host until expiry: the expiry as a Unix time and the hex HMAC-SHA256 of
+// "<expiry>:<host>", separated by a colon.
+func DebugToken(secret, host string, expiry time.Time) string {
+	timestamp := strconv.FormatInt(expiry.Unix(), 10)
+	return timestamp + ":" + hex.EncodeToString(debugSignature(secret, timestamp, host))
+}
+
+func debugSignature(secret, timestamp, host string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + ":" + host))
+	return mac.Sum(nil)
+}
+
+// debugRequested reports whether a request carries a valid debug token that
+// hasn't expired, and doesn't expire further ahead than the maximum lifetime.
+func (c *DebugConfig) debugRequested(req *http.Request, now time.Time) bool {
+	token := req.Header.Get(debugHeader)
+	if c.Secret == "" || token == "" {
+		return false
+	}
+
+	i := strings.IndexByte(token, ':')
+	if i < 0 {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil || now.Unix() > expiry || expiry > now.Add(c.maxTokenLifetime()).Unix() {
+		return false
+	}
+
+	signature, err := hex.DecodeString(token[i+1:])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(signature, debugSignature(c.Secret, token[:i], req.Host))
+}
+
+func (c *DebugConfig) maxTokenLifetime() time.Duration {
+	if c.MaxTokenLifetime <= 0 {
+		return DefaultDebugTokenLifetime
+	}
+	return c.MaxTokenLifetime
+}
@@ -0,0 +1,186 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/accesslog"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+)
+
+// ShadowHeader marks requests sent to a mirror.
+const ShadowHeader = "X-Shadow-Request"
+
+// MirrorConfig describes how shadow traffic is sent to mirrors.
+type MirrorConfig struct {
+	// QueueSize is the number of shadow requests that can wait for a worker
+	// before more are dropped.
+	QueueSize, Workers int
+
+	// MaxBody is the largest request body, in bytes, that is buffered to be
+	// sent to a mirror. Requests with larger bodies aren't mirrored.
+	MaxBody int64
+
+	Timeout time.Duration
+}
+
+// shadowRequest is a request waiting to be sent to a mirror, along with what
+// the primary upstream made of it.
+type shadowRequest struct {
+	req  *http.Request
+	body []byte
+
+	primaryStatus   int
+	primaryDuration time.Duration
+}
+
+// mirror sends shadow requests from a bounded queue, so that mirroring never
+// holds up the primary request.
+type mirror struct {
+	client  *http.Client
+	queue   chan *shadowRequest
+	maxBody int64
+	metrics metrics.Metrics
+}
+
+func newMirror(config MirrorConfig, transport http.RoundTripper, stats metrics.Metrics) *mirror {
+	m := &mirror{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+			// Shadow requests are never retried, including by following redirects.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue:   make(chan *shadowRequest, config.QueueSize),
+		maxBody: config.MaxBody,
+		metrics: metrics.OrNop(stats),
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		go m.work()
+	}
+	return m
+}
+
+// prepare copies a request for a mirror at host, buffering the body. req's
+// body is replaced so that it can still be read in full by the primary. If
+// the body is larger than the limit, nil is returned.
+func (m *mirror) prepare(req *http.Request, host string) *shadowRequest {
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > m.maxBody {
+			m.metrics.Count("mirror_body_too_large", 1, nil)
+			return nil
+		}
+
+		buf, err := ioutil.ReadAll(io.LimitReader(req.Body, m.maxBody+1))
+		if err != nil {
+			requestLog(req).Errorln("Error buffering request for mirror:", req.Host, req.URL.Path, err)
+			req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buf), req.Body))
+			return nil
+		}
+
+		// Stitch the buffered part back on to what's left of the body.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+
+		if int64(len(buf)) > m.maxBody {
+			m.metrics.Count("mirror_body_too_large", 1, nil)
+			return nil
+		}
+		body = buf
+	}
+
+	url := *req.URL
+	url.Scheme = "http"
+	url.Host = host
+
+	shadow := &http.Request{
+		Method:        req.Method,
+		URL:           &url,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header, len(req.Header)+1),
+		Host:          req.Host,
+		ContentLength: int64(len(body)),
+	}
+	for key, values := range req.Header {
+		shadow.Header[key] = append([]string(nil), values...)
+	}
+	shadow.Header.Set(ShadowHeader, "1")
+
+	return &shadowRequest{req: shadow, body: body}
+}
+
+// submit queues a shadow request once the primary request has been handled,
+// dropping it if the queue is full.
+func (m *mirror) submit(shadow *shadowRequest, entry *accesslog.Entry) {
+	if entry != nil {
+		shadow.primaryStatus = entry.UpstreamStatus
+		shadow.primaryDuration = entry.UpstreamDuration
+	}
+
+	select {
+	case m.queue <- shadow:
+	default:
+		m.metrics.Count("mirror_dropped", 1, nil)
+	}
+}
+
+func statusClass(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+func (m *mirror) work() {
+	for shadow := range m.queue {
+		m.send(shadow)
+	}
+}
+
+// send makes a shadow request, discarding the response, and records how it
+// compares to the primary.
+func (m *mirror) send(shadow *shadowRequest) {
+	if shadow.body != nil {
+		shadow.req.Body = ioutil.NopCloser(bytes.NewReader(shadow.body))
+	}
+
+	start := time.Now()
+	status := 0
+	resp, err := m.client.Do(shadow.req)
+	if err != nil {
+		log.Debugln("Mirror error:", shadow.req.URL.Host, shadow.req.URL.Path, err)
+	} else {
+		status = resp.StatusCode
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	duration := time.Since(start)
+
+	tags := []string{
+		"mirror:" + shadow.req.URL.Host,
+		"primary_status:" + statusClass(shadow.primaryStatus),
+		"mirror_status:" + statusClass(status),
+	}
+	m.metrics.Count("mirror_response", 1, tags)
+	if shadow.primaryStatus != status {
+		m.metrics.Count("mirror_status_mismatch", 1, tags[:1])
+	}
+	if shadow.primaryStatus != 0 {
+		m.metrics.Timing("mirror_latency", shadow.primaryDuration, []string{tags[0], "side:primary"})
+	}
+	m.metrics.Timing("mirror_latency", duration, []string{tags[0], "side:mirror"})
+}
@@ -2,40 +2,66 @@ package router
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/newsdev/kubernetes-dns-reverse-proxy/accesslog"
 	"github.com/newsdev/kubernetes-dns-reverse-proxy/director"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/forwarded"
 	"github.com/newsdev/kubernetes-dns-reverse-proxy/httpwrapper"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/proxyproto"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/redirectmap"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/requestid"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/tracing"
 
-	"github.com/newsdev/kubernetes-dns-reverse-proxy/datadog"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
 )
 
 // Config is a configuration data structure for the router.
 type Config struct {
 	Address, StatusAddress        string
 	DomainSuffixesRaw             string
+	TrustedProxiesRaw             string
 	RoutesFilename                string
+	RoutesReload                  time.Duration
 	Concurrency, CompressionLevel int
 	Timeout                       time.Duration
 	ValidateRoutes                bool
 	Verbose                       bool
 
+	// BrotliLevel and ZstdLevel are the levels to compress responses at with
+	// Brotli and zstd, alongside gzip at CompressionLevel. 0 disables them.
+	BrotliLevel, ZstdLevel int
+
 	Kubernetes KubernetesConfig
 
 	Static   StaticBackendConfig
 	Fallback FallbackConfig
+	Mirror   MirrorConfig
+
+	Compression   CompressionConfig
+	AccessLog     AccessLogConfig
+	ProxyProtocol ProxyProtocolConfig
+	Debug         DebugConfig
+
+	// Metrics, if set, receives the proxy's metrics.
+	Metrics metrics.Metrics
+
+	// Tracer, if set, traces requests.
+	Tracer *tracing.Tracer
+
+	// RedirectMaps, if set, is consulted for exact-path redirects before the
+	// routes.
+	RedirectMaps *redirectmap.Maps
 }
 
 // KubernetesConfig describes properties of the Kubernetes back-end.
@@ -55,61 +81,311 @@ type FallbackConfig struct {
 	Scheme, Host, Path string
 }
 
+// CompressionConfig describes which responses are compressed.
+type CompressionConfig struct {
+	// TypesRaw is a comma separated list of the media types to compress,
+	// which may have wildcard subtypes, e.g. text/*. Empty means
+	// httpwrapper.DefaultCompressibleTypes.
+	TypesRaw string
+
+	// MinSize is the smallest response to compress, if its length is known.
+	MinSize int64
+
+	// OptIn only compresses responses for routes that enable compression.
+	OptIn bool
+
+	// Recompress compresses gzip responses decoded for clients that don't
+	// accept gzip with a coding they do accept.
+	Recompress bool
+}
+
+// Types gets the media types to compress.
+func (c *CompressionConfig) Types() []string {
+	var types []string
+	for _, mediaType := range strings.Split(c.TypesRaw, ",") {
+		if mediaType = strings.TrimSpace(mediaType); mediaType != "" {
+			types = append(types, mediaType)
+		}
+	}
+	return types
+}
+
+// AccessLogConfig describes the format of the access log.
+type AccessLogConfig struct {
+	// Format is one of custom, combined or json.
+	Format string
+
+	// FieldsRaw is a comma separated list of the fields in JSON access logs.
+	FieldsRaw string
+
+	// RulesFilename is the path to a JSON file of per-host sampling,
+	// filtering and redaction rules.
+	RulesFilename string
+
+	// Sink is where the access log is written.
+	Sink accesslog.SinkConfig
+
+	// BufferSize is the number of lines queued for the sink, and DropPolicy
+	// is one of newest, oldest or none, saying what happens when it's full.
+	BufferSize int
+	DropPolicy string
+}
+
+// ProxyProtocolConfig describes which connections to the main listener may
+// start with a PROXY protocol header.
+type ProxyProtocolConfig struct {
+	Enable bool
+
+	// TrustedRaw is a comma separated list of the CIDRs or IP addresses of
+	// the load balancers that send headers.
+	TrustedRaw string
+
+	// Timeout limits how long reading a header may take.
+	Timeout time.Duration
+}
+
+// DebugConfig describes when responses carry debug headers, which give
+// internal details like the upstream URL.
+type DebugConfig struct {
+	// Headers adds debug headers to every response.
+	Headers bool
+
+	// Secret, if set, signs the tokens of requests asking for debug headers.
+	Secret string
+
+	// MaxTokenLifetime limits how far in the future a token may expire, so
+	// that a leaked token can't be used indefinitely. DefaultDebugTokenLifetime
+	// is used if it isn't positive.
+	MaxTokenLifetime time.Duration
+}
+
+// DefaultDebugTokenLifetime is the longest a debug token may be valid for, if
+// no maximum is configured.
+const DefaultDebugTokenLifetime = time.Hour
+
 // DomainSuffixes gets a comma separated list of the service domain suffixes.
 func (c *Config) DomainSuffixes() []string {
 	return strings.Split(c.DomainSuffixesRaw, ",")
 }
 
+// TrustedProxies gets the networks of the proxies trusted to say who the
+// client is, from a comma separated list of CIDRs or IP addresses.
+func (c *Config) TrustedProxies() (forwarded.Proxies, error) {
+	return forwarded.ParseProxies(c.TrustedProxiesRaw)
+}
+
 // KubernetesServiceDomainSuffix gets the Kubernetes service domain suffix.
 // When appended to a service name, gives a hostname that a service is available on.
 func (c *Config) KubernetesServiceDomainSuffix() string {
 	return fmt.Sprintf(".%s.%s", c.Kubernetes.Namespace, c.Kubernetes.DNSDomain)
 }
 
-// NewKubernetesRouter gives you a router instance.
-func NewKubernetesRouter(config *Config) (*http.Server, error) {
+// requestLog gets a logger which adds the ID of a request to each line.
+func requestLog(req *http.Request) *log.Entry {
+	return log.WithField("request_id", requestid.FromRequest(req))
+}
 
-	log.Infoln("Domain suffixes:", config.DomainSuffixes())
-	log.Infoln("Kubernetes service domain suffix:", config.KubernetesServiceDomainSuffix())
+// errorPage responds with an error page giving the request ID, for readers to
+// quote when reporting a problem.
+func errorPage(w http.ResponseWriter, req *http.Request, status int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%d %s\nRequest ID: %s\n", status, http.StatusText(status), requestid.FromRequest(req))
+}
 
-	// Create a new director object.
-	dir := director.NewDirector()
+type responseHeadersKey struct{}
 
-	// Check for a routes JSON file.
-	if config.ValidateRoutes || config.RoutesFilename != "" {
+// withResponseHeaders gets a copy of a request carrying the response header
+// rules of its route, expanded for the request.
+func withResponseHeaders(req *http.Request, rules *director.HeaderRules) *http.Request {
+	if rules == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), responseHeadersKey{}, rules))
+}
 
-		routesFile, err := os.Open(config.RoutesFilename)
-		if err != nil {
-			return nil, err
+// responseHeaders gets the response header rules carried by a request, if any.
+func responseHeaders(req *http.Request) *director.HeaderRules {
+	rules, _ := req.Context().Value(responseHeadersKey{}).(*director.HeaderRules)
+	return rules
+}
+
+// countInFlight keeps a gauge of the requests being handled by h.
+func countInFlight(h http.Handler, m metrics.Metrics) http.Handler {
+	var inFlight int64
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.Gauge("requests_in_flight", float64(atomic.AddInt64(&inFlight, 1)), nil)
+		defer func() {
+			m.Gauge("requests_in_flight", float64(atomic.AddInt64(&inFlight, -1)), nil)
+		}()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// recordMetrics gets a recorder which sends the count and timings of a
+// request to m once it has been handled. Hosts the proxy isn't configured for
+// are tagged as "other".
+func recordMetrics(m metrics.Metrics) accesslog.Recorder {
+	return func(req *http.Request, entry *accesslog.Entry) {
+		// Redirect maps log the path as the prefix, which is one series too
+		// many per redirect.
+		route := entry.Prefix
+		if entry.RouteKind == "redirect_map" {
+			route = ""
 		}
 
-		routesJSON, err := ioutil.ReadAll(routesFile)
-		if err != nil {
-			return nil, err
+		tags := []string{
+			"host:" + entry.HostTag(),
+			"route_kind:" + entry.RouteKind,
+			"route:" + route,
+			"upstream:" + entry.Upstream,
+			"status_class:" + statusClass(entry.Status),
+		}
+		m.Count("requests", 1, tags)
+		m.Timing("request_duration", entry.Duration, tags)
+		if entry.TTFB > 0 {
+			m.Timing("ttfb", entry.TTFB, tags)
 		}
+	}
+}
+
+// recordSpan adds what's known about a request once it has been handled to
+// its span.
+func recordSpan(req *http.Request, entry *accesslog.Entry) {
+	span := tracing.FromRequest(req)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("client.address", forwarded.ClientIP(req))
+	span.SetAttribute("server.address", entry.Host)
+	span.SetAttribute("proxy.route_kind", entry.RouteKind)
+	span.SetAttribute("http.route", entry.Prefix)
+	if entry.Upstream != "" {
+		span.SetAttribute("proxy.upstream", entry.Upstream)
+	}
+	span.SetAttribute("http.response.status_code", entry.Status)
+	if entry.Status >= 500 {
+		span.SetError(http.StatusText(entry.Status))
+	}
+}
 
-		if err := routesFile.Close(); err != nil {
+// Listen listens on the router's address, reading PROXY protocol headers from
+// trusted load balancers if enabled.
+func Listen(config *Config) (net.Listener, error) {
+	var trusted forwarded.Proxies
+	if config.ProxyProtocol.Enable {
+		var err error
+		if trusted, err = forwarded.ParseProxies(config.ProxyProtocol.TrustedRaw); err != nil {
 			return nil, err
 		}
+	}
+
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.ProxyProtocol.Enable {
+		return listener, nil
+	}
+	return &proxyproto.Listener{
+		Listener: listener,
+		Trusted:  trusted,
+		Timeout:  config.ProxyProtocol.Timeout,
+	}, nil
+}
+
+// Server is the router's HTTP server, along with the access log it writes to.
+type Server struct {
+	*http.Server
+	accessLog  []io.Closer
+	stopReopen func()
+}
+
+// Shutdown gracefully shuts down the server, as http.Server.Shutdown does,
+// then writes out any queued access log lines and closes the access log.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if closeErr := s.closeAccessLog(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-		var routes map[string]map[string]string
-		if err := json.Unmarshal(routesJSON, &routes); err != nil {
+// closeAccessLog stops reopening the access log on SIGUSR1 and closes it.
+func (s *Server) closeAccessLog() error {
+	if s.stopReopen != nil {
+		s.stopReopen()
+	}
+
+	var err error
+	for _, c := range s.accessLog {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// NewKubernetesRouter gives you a router instance.
+func NewKubernetesRouter(config *Config) (*Server, error) {
+
+	log.Infoln("Domain suffixes:", config.DomainSuffixes())
+	log.Infoln("Kubernetes service domain suffix:", config.KubernetesServiceDomainSuffix())
+
+	stats := metrics.OrNop(config.Metrics)
+
+	trustedProxies, err := config.TrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a route table with an empty director.
+	routes := &routeTable{
+		filename: config.RoutesFilename,
+		metrics:  stats,
+		director: director.NewDirector(stats),
+	}
+
+	// Check for a routes JSON file.
+	if config.ValidateRoutes || config.RoutesFilename != "" {
+		if _, err := routes.reload(); err != nil {
 			return nil, err
 		}
 
-		for domain, prefixMap := range routes {
-			for prefix, service := range prefixMap {
-				dir.SetService(domain, prefix, service)
-			}
+		if config.RoutesReload > 0 && !config.ValidateRoutes {
+			go routes.watch(config.RoutesReload)
 		}
 	}
 
+	compressionLevels := map[string]int{
+		httpwrapper.Brotli: config.BrotliLevel,
+		httpwrapper.Zstd:   config.ZstdLevel,
+		httpwrapper.Gzip:   config.CompressionLevel,
+	}
+	if err := httpwrapper.ValidateCompressionLevels(compressionLevels); err != nil {
+		return nil, err
+	}
+
+	compressibleTypes := config.Compression.Types()
+	if err := httpwrapper.ValidateMediaTypes(compressibleTypes); err != nil {
+		return nil, err
+	}
+
+	// Responses are compressed as they're written back to the client.
+	compressor := &httpwrapper.Compressor{
+		Levels:     compressionLevels,
+		Types:      compressibleTypes,
+		MinSize:    config.Compression.MinSize,
+		Recompress: config.Compression.Recompress,
+		Metrics:    stats,
+	}
+
 	// Build the reverse proxy HTTP handler.
 	reverseProxy := &httputil.ReverseProxy{
-		// Specify a custom transport which rate limits requests and compresses responses.
+		// Specify a custom transport which rate limits requests.
 		Transport: &httpwrapper.Transport{
 			MaxConcurrencyPerHost: config.Concurrency,
-			CompressionLevel:      config.CompressionLevel,
+			Metrics:               stats,
 			Transport: &http.Transport{
 				MaxIdleConnsPerHost: config.Concurrency,
 				DisableKeepAlives:   true,
@@ -123,121 +399,281 @@ func NewKubernetesRouter(config *Config) (*http.Server, error) {
 		Director: func(req *http.Request) {
 			// empty director atm
 		},
+		ModifyResponse: func(resp *http.Response) error {
+			responseHeaders(resp.Request).Apply(resp.Header)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			requestLog(req).Errorln("Proxy error:", req.Host, req.URL.Host, req.URL.Path, err)
+			responseHeaders(req).Apply(w.Header())
+			errorPage(w, req, http.StatusBadGateway)
+		},
 	}
 
-	return &http.Server{
-			Addr: config.Address,
-			Handler: accesslog.CustomLoggingHandler(
-				os.Stdout,
-				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-					// Drop the connection header to ensure keepalives are maintained.
-					req.Header.Del("connection")
-
-					if root, prefix, err := dir.Service(req.Host, req.URL.Path); err != nil {
-						// The director didn't find a match, handle it gracefully.
-
-						if err != director.NoMatchingServiceError {
-							log.Errorln("Error:", req.Host, req.URL.Path, err)
-						} else {
-
-							// If NoMatchingServiceError is thrown, check against the domain suffixes, e.g. {service}.local
-							for _, domainSuffix := range config.DomainSuffixes() {
-								if root := strings.TrimSuffix(req.Host, domainSuffix); root != req.Host {
-									req.URL.Scheme = "http"
-									req.URL.Host = root + config.KubernetesServiceDomainSuffix()
-									log.Debug("Domain Suffix Match:", req.Host, req.URL.Host, req.URL.Path)
-									reverseProxy.ServeHTTP(w, req)
-									return
-								}
-							}
-
-							// Otherwise, send traffic to the fallback.
-							if config.Fallback.Enable {
-
-								// Set the URL scheme, host, and path.
-								req.URL.Scheme = config.Fallback.Scheme
-								req.URL.Host = config.Fallback.Host
-								req.URL.Path = path.Join(config.Fallback.Path, req.URL.Path)
-								datadog.Count("fallback", 1, nil, 1.0)
-								log.Debug("Fallback:", req.Host, req.URL.Path, " to ", req.URL.Host)
-							} else {
-								datadog.Count("no_route_matched_no_fallback_enabled", 1, nil, 1.0)
-								log.Errorln("No route matched and fallback not enabled for", req.Host, req.URL.Path)
-							}
+	// Mirrors get a transport of their own so that shadow traffic doesn't
+	// count towards the concurrency limits of the primary upstreams.
+	mirrors := newMirror(config.Mirror, &http.Transport{
+		MaxIdleConnsPerHost: config.Mirror.Workers,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, config.Timeout)
+		},
+	}, stats)
 
-						}
+	accessLogFields, err := accesslog.ParseJSONFields(config.AccessLog.FieldsRaw)
+	if err != nil {
+		return nil, err
+	}
 
-					} else {
-						// The director found a match.
-
-						if config.Static.Enable && strings.HasPrefix(root, "/") {
-							// Handle static file requests.
-
-							// we need to modify response
-							// with equivalent of nginx
-							// proxy_redirect /<%= application.name %>/ /;
-							// http://nginx.org/en/docs/http/ngx_http_proxy_module.html#proxy_redirect
-							// // Sets the text that should be changed in the “Location” and “Refresh” header
-							// // fields of a proxied server response.
-							// Otherwise, AWS returned redirects will have wrong paths
-							//
-							// for example
-							// curl -v http://well.127.0.0.1.xip.io:8080/projects/workouts
-							// Location: /well_workout/projects/workouts/
-							// needs to get rewritten to
-							// Location: /projects/workouts/
-							// so
-							// here we set headers so that
-							// in httpwrapper.Transport.RoundTrip we know what's needed to  be replaced
-							req.Header.Add("x-static-root", path.Join(config.Static.Path, root)+"/")
-							req.Header.Add("x-original-url", req.Host+req.URL.String())
-
-							// Set the URL scheme, host, and path.
-							req.URL.Scheme = config.Static.Scheme
-							req.URL.Host = config.Static.Host
-
-							log.Debugln("Path: ", req.URL.Path)
-							trailing := strings.HasSuffix(req.URL.Path, "/")
-
-							req.URL.Path = path.Join(config.Static.Path, root, req.URL.Path)
-							if trailing && !strings.HasSuffix(req.URL.Path, "/") {
-								req.URL.Path += "/"
-							}
-
-							// Set the request host (used as the "Host" header value).
-							req.Host = config.Static.Host
-
-							// Drop cookies given that the response should not vary.
-							req.Header.Del("cookie")
-
-							log.Debugln("Static:", req.Header.Get("x-original-url"), "to", req.URL.Host+req.URL.Path)
-
-						} else if redirectURLString := strings.TrimPrefix(root, ">"); redirectURLString != root {
-							// log.Println("Path:", req.URL.Path)
-							redirectURL, err := url.Parse(redirectURLString)
-							if err != nil {
-								log.Error(err)
-							}
-							redirectURL.Path = path.Join(redirectURL.Path, strings.Replace(req.URL.Path, prefix, "/", 1))
-							if req.URL.RawQuery != "" {
-								redirectURL.RawQuery = req.URL.RawQuery
-							}
-							datadog.Count("redirect_301", 1, nil, 1.0)
-							log.Debug("Redirect: %s%s to %s", req.Host, req.URL.Path, redirectURL.String())
-							http.Redirect(w, req, redirectURL.String(), 301)
-							return
-						} else {
-							// Handle an arbitrary URL routing to a service.
+	recordRequest := recordMetrics(stats)
+	accessLogOptions := accesslog.Options{
+		Format: config.AccessLog.Format,
+		Fields: accessLogFields,
+	}
+	accessLogOptions.Recorder = func(req *http.Request, entry *accesslog.Entry) {
+		recordRequest(req, entry)
+		recordSpan(req, entry)
+	}
+
+	if config.AccessLog.RulesFilename != "" {
+		if accessLogOptions.Rules, err = accesslog.LoadRules(config.AccessLog.RulesFilename); err != nil {
+			return nil, err
+		}
+	}
+
+	dropPolicy, err := accesslog.ParseDropPolicy(config.AccessLog.DropPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The access log is only opened if the server is going to serve.
+	server := &Server{}
+	var accessLogWriter io.Writer = ioutil.Discard
+	if !config.ValidateRoutes {
+		sink, err := accesslog.OpenSink(config.AccessLog.Sink)
+		if err != nil {
+			return nil, err
+		}
+
+		writer := accesslog.NewAsyncWriter(sink, config.AccessLog.BufferSize, dropPolicy, func() {
+			stats.Count("access_log_dropped", 1, nil)
+		})
+		accessLogWriter = writer
+
+		// The queue is drained before the sink it writes to is closed.
+		server.accessLog = []io.Closer{writer, sink}
+		if reopener, ok := sink.(accesslog.Reopener); ok {
+			server.stopReopen = accesslog.ReopenOnSignal(reopener)
+		}
+	}
+
+	handler, err := accesslog.NewHandler(
+		accessLogWriter,
+		accessLogOptions,
+		compressor.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Drop the connection header to ensure keepalives are maintained.
+			req.Header.Del("connection")
+
+			// Check whether the client asked for debug headers, then strip
+			// the internal headers so they can't be spoofed to upstreams.
+			debug := config.Debug.Headers || config.Debug.debugRequested(req, time.Now())
+			for _, name := range internalHeaders {
+				req.Header.Del(name)
+			}
+			if debug {
+				req = httpwrapper.WithDebug(req)
+			}
 
+			// Routes that change the path set the prefix the upstream sees in
+			// place of the public one, so that URLs in the response headers
+			// can be mapped back.
+			rewrite := &httpwrapper.Rewrite{Host: req.Host, Prefix: "/", UpstreamPrefix: "/"}
+
+			// Routes can turn compression on or off for themselves.
+			httpwrapper.SetCompression(req, !config.Compression.OptIn)
+
+			// Exact-path redirect maps take precedence over the routes.
+			if config.RedirectMaps != nil {
+				if entry, ok := config.RedirectMaps.Lookup(req.Host, req.URL.Path); ok {
+					location := entry.Location(req.URL)
+					accesslog.GetEntry(req).SetRoute("redirect_map", req.URL.Path)
+					accesslog.GetEntry(req).SetHostTag(req.Host)
+					stats.Count("redirect_map", 1, nil)
+					log.Debugln("Redirect map:", req.Host+req.URL.Path, "to", location)
+					http.Redirect(w, req, location, entry.StatusCode())
+					return
+				}
+			}
+
+			// A sample of requests to routes with a mirror is copied to
+			// be sent to the mirror once the primary request is done.
+			var shadow *shadowRequest
+
+			routeSpan := tracing.FromRequest(req).Child("route", tracing.Internal)
+			route, prefix, err := routes.Director().Route(req)
+			routeSpan.End()
+
+			if err != nil {
+				// The director didn't find a match, handle it gracefully.
+
+				if err != director.NoMatchingServiceError {
+					requestLog(req).Errorln("Error:", req.Host, req.URL.Path, err)
+				} else {
+
+					// If NoMatchingServiceError is thrown, check against the domain suffixes, e.g. {service}.local
+					for _, domainSuffix := range config.DomainSuffixes() {
+						if root := strings.TrimSuffix(req.Host, domainSuffix); root != req.Host {
 							req.URL.Scheme = "http"
 							req.URL.Host = root + config.KubernetesServiceDomainSuffix()
-							log.Debugln("Proxy:", req.Host+req.URL.Path, "to", req.URL.Host)
+							accesslog.GetEntry(req).SetRoute("domain_suffix", "")
+							accesslog.GetEntry(req).SetHostTag("*" + domainSuffix)
+							log.Debug("Domain Suffix Match:", req.Host, req.URL.Host, req.URL.Path)
+							reverseProxy.ServeHTTP(w, httpwrapper.WithRewrite(req, rewrite))
+							return
 						}
 					}
 
-					reverseProxy.ServeHTTP(w, req)
-				}),
-			),
-		},
-		nil
+					// Otherwise, send traffic to the fallback.
+					if config.Fallback.Enable {
+
+						// Set the URL scheme, host, and path.
+						req.URL.Scheme = config.Fallback.Scheme
+						req.URL.Host = config.Fallback.Host
+						req.URL.Path = path.Join(config.Fallback.Path, req.URL.Path)
+						rewrite.UpstreamPrefix = config.Fallback.Path
+						accesslog.GetEntry(req).SetRoute("fallback", "")
+						stats.Count("fallback", 1, nil)
+						log.Debug("Fallback:", req.Host, req.URL.Path, " to ", req.URL.Host)
+					} else {
+						stats.Count("no_route_matched_no_fallback_enabled", 1, nil)
+						accesslog.GetEntry(req).SetRoute("none", "")
+						requestLog(req).Errorln("No route matched and fallback not enabled for", req.Host, req.URL.Path)
+					}
+
+				}
+
+			} else {
+				// The director found a match.
+				accesslog.GetEntry(req).SetHostTag(req.Host)
+				if route.Compress != nil {
+					httpwrapper.SetCompression(req, *route.Compress)
+				}
+
+				// Apply the route's header rules, expanded for the request as
+				// it arrived rather than as the route rewrites it.
+				route.Headers.Request.Expand(req, prefix).Apply(req.Header)
+				req = withResponseHeaders(req, route.Headers.Response.Expand(req, prefix))
+
+				if config.Static.Enable && route.IsStatic() {
+					// Handle static file requests.
+					accesslog.GetEntry(req).SetRoute("static", prefix)
+
+					// we need to modify response
+					// with equivalent of nginx
+					// proxy_redirect /<%= application.name %>/ /;
+					// http://nginx.org/en/docs/http/ngx_http_proxy_module.html#proxy_redirect
+					// // Sets the text that should be changed in the “Location” and “Refresh” header
+					// // fields of a proxied server response.
+					// Otherwise, AWS returned redirects will have wrong paths
+					//
+					// for example
+					// curl -v http://well.127.0.0.1.xip.io:8080/projects/workouts
+					// Location: /well_workout/projects/workouts/
+					// needs to get rewritten to
+					// Location: /projects/workouts/
+					// so
+					// here we set the upstream prefix so that
+					// in httpwrapper.Transport.RoundTrip we know what's needed to  be replaced
+					rewrite.UpstreamPrefix = path.Join(config.Static.Path, route.Service)
+					originalURL := req.Host + req.URL.String()
+
+					// Set the URL scheme, host, and path.
+					req.URL.Scheme = config.Static.Scheme
+					req.URL.Host = config.Static.Host
+
+					log.Debugln("Path: ", req.URL.Path)
+					trailing := strings.HasSuffix(req.URL.Path, "/")
+
+					req.URL.Path = path.Join(config.Static.Path, route.Service, req.URL.Path)
+					if trailing && !strings.HasSuffix(req.URL.Path, "/") {
+						req.URL.Path += "/"
+					}
+
+					// Set the request host (used as the "Host" header value).
+					req.Host = config.Static.Host
+
+					// Drop cookies given that the response should not vary.
+					req.Header.Del("cookie")
+
+					log.Debugln("Static:", originalURL, "to", req.URL.Host+req.URL.Path)
+
+				} else if route.Redirect != nil {
+					accesslog.GetEntry(req).SetRoute("redirect", prefix)
+					redirectURL, err := route.Redirect.Target(req.Host, req.URL, prefix)
+					if err != nil {
+						requestLog(req).Errorln("Error:", req.Host, req.URL.Path, err)
+						errorPage(w, req, http.StatusInternalServerError)
+						return
+					}
+					status := route.Redirect.StatusCode()
+					stats.Count(fmt.Sprintf("redirect_%d", status), 1, nil)
+					log.Debugln("Redirect:", req.Host+req.URL.Path, "to", redirectURL.String())
+					responseHeaders(req).Apply(w.Header())
+					http.Redirect(w, req, redirectURL.String(), status)
+					return
+				} else if len(route.Targets) > 0 {
+					// Handle a route splitting traffic between services.
+
+					accesslog.GetEntry(req).SetRoute("targets", prefix)
+					target, cookie := route.PickTarget(req)
+					if cookie != nil {
+						http.SetCookie(w, cookie)
+					}
+					accesslog.GetEntry(req).SetVariant(target.Service)
+
+					req.URL.Scheme = "http"
+					req.URL.Host = target.Service + config.KubernetesServiceDomainSuffix()
+					log.Debugln("Proxy:", req.Host+req.URL.Path, "to", req.URL.Host, "as variant", target.Service)
+				} else {
+					// Handle an arbitrary URL routing to a service.
+					accesslog.GetEntry(req).SetRoute("service", prefix)
+
+					req.URL.Scheme = "http"
+					req.URL.Host = route.Service + config.KubernetesServiceDomainSuffix()
+					log.Debugln("Proxy:", req.Host+req.URL.Path, "to", req.URL.Host)
+				}
+
+				// Rewrite the path for services that don't know their public
+				// prefix, passing it on for them to build links with.
+				if route.Rewrite != nil {
+					req.URL.Path = route.Rewrite.Apply(req.URL.Path, prefix)
+					req.URL.RawPath = ""
+					forwarded.AddPrefix(req.Header, prefix)
+					if upstreamPrefix, ok := route.Rewrite.UpstreamPrefix(); ok {
+						rewrite.Prefix, rewrite.UpstreamPrefix = prefix, upstreamPrefix
+					}
+					log.Debugln("Rewrite:", prefix, "to", req.URL.Path)
+				}
+
+				if route.Mirror != nil && route.Mirror.Sample() {
+					shadow = mirrors.prepare(req, route.Mirror.Service+config.KubernetesServiceDomainSuffix())
+				}
+			}
+
+			reverseProxy.ServeHTTP(w, httpwrapper.WithRewrite(req, rewrite))
+
+			if shadow != nil {
+				mirrors.submit(shadow, accesslog.GetEntry(req))
+			}
+		})),
+	)
+	if err != nil {
+		server.closeAccessLog()
+		return nil, err
+	}
+
+	server.Server = &http.Server{
+		Addr:    config.Address,
+		Handler: countInFlight(requestid.Handler(trustedProxies.Handler(config.Tracer.Handler(handler))), stats),
+	}
+	return server, nil
 }
@@ -1,12 +1,23 @@
 package router
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/accesslog"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/tracing"
 )
 
 func TestRouter(t *testing.T) {
@@ -21,34 +32,25 @@ func TestRouter(t *testing.T) {
 				},
 				"www.dogs.com": {
 					"/brown": ">https://www.cats.com",
+					"/grey": {"redirect": {"location": "https://www.cats.com/grey", "status": 307, "path": "fixed", "query": "drop"}},
 					"/": ">https://www.cats.com"
 				}
 			}`,
 			Config{
-				"",
-				"",
-				"",
-				"",
-				32,
-				4,
-				time.Minute,
-				false,
-				false,
-				KubernetesConfig{
-					"default",
-					"svc.cluster.local",
+				Concurrency:      32,
+				CompressionLevel: 4,
+				Timeout:          time.Minute,
+				Kubernetes: KubernetesConfig{
+					Namespace: "default",
+					DNSDomain: "svc.cluster.local",
 				},
-				StaticBackendConfig{
-					false,
-					"http",
-					"",
-					"/",
+				Static: StaticBackendConfig{
+					Scheme: "http",
+					Path:   "/",
 				},
-				FallbackConfig{
-					false,
-					"http",
-					"",
-					"/",
+				Fallback: FallbackConfig{
+					Scheme: "http",
+					Path:   "/",
 				},
 			},
 		},
@@ -75,19 +77,18 @@ func TestRouter(t *testing.T) {
 			t.Fatal("Can't create router")
 		}
 
-
 		request, err := http.NewRequest("GET", "http://www.cats.com/tabby", nil)
 		if err != nil {
 			t.Fatal("bad given test URL")
 		}
 		// Save the URL for later.
-		request.Header.Add("X-Original-URL", request.URL.String())
+		originalURL := request.URL.String()
 		// Add a connection header, which the ReverseProxy should drop.
 		request.Header.Add("connection", "glerf")
 		responseRecorder := httptest.NewRecorder()
 		router.Handler.ServeHTTP(responseRecorder, request)
 		if request.URL.Host != "cats.default.svc.cluster.local" {
-			t.Errorf("The router should have rewritten the request %s to %s, but it was mapped to %s", request.Header.Get("X-Original-URL"), "cats.default.svc.cluster.local", request.URL.Host)
+			t.Errorf("The router should have rewritten the request %s to %s, but it was mapped to %s", originalURL, "cats.default.svc.cluster.local", request.URL.Host)
 		}
 		if request.Header.Get("connection") != "" {
 			t.Error("The router should drop the connection header, it did not.")
@@ -97,18 +98,17 @@ func TestRouter(t *testing.T) {
 		responseRecorder = httptest.NewRecorder()
 		router.Handler.ServeHTTP(responseRecorder, request)
 		if responseRecorder.Code != 301 {
-			t.Errorf("Should return a 301, but it returned %s", responseRecorder.Code)
+			t.Errorf("Should return a 301, but it returned %d", responseRecorder.Code)
 		}
 		if responseRecorder.HeaderMap.Get("Location") != "https://www.cats.com/" {
 			t.Errorf("Should return a redirect Location to https://www.cats.com/, but it returned %s", responseRecorder.HeaderMap.Get("Location"))
 		}
 
-
 		request, err = http.NewRequest("GET", "http://www.dogs.com/brown/good", nil)
 		responseRecorder = httptest.NewRecorder()
 		router.Handler.ServeHTTP(responseRecorder, request)
 		if responseRecorder.Code != 301 {
-			t.Errorf("Should return a 301, but it returned %s", responseRecorder.Code)
+			t.Errorf("Should return a 301, but it returned %d", responseRecorder.Code)
 		}
 		if responseRecorder.HeaderMap.Get("Location") != "https://www.cats.com/good" {
 			t.Errorf("Should return a redirect Location to https://www.cats.com/good, but it returned %s", responseRecorder.HeaderMap.Get("Location"))
@@ -118,12 +118,730 @@ func TestRouter(t *testing.T) {
 		responseRecorder = httptest.NewRecorder()
 		router.Handler.ServeHTTP(responseRecorder, request)
 		if responseRecorder.Code != 301 {
-			t.Errorf("Should return a 301, but it returned %s", responseRecorder.Code)
+			t.Errorf("Should return a 301, but it returned %d", responseRecorder.Code)
 		}
 		if responseRecorder.HeaderMap.Get("Location") != "https://www.cats.com/yellow" {
 			t.Errorf("Should return a redirect Location to https://www.cats.com/yellow, but it returned %s", responseRecorder.HeaderMap.Get("Location"))
 		}
 
+		request, err = http.NewRequest("GET", "http://www.dogs.com/grey/old?a=1", nil)
+		responseRecorder = httptest.NewRecorder()
+		router.Handler.ServeHTTP(responseRecorder, request)
+		if responseRecorder.Code != 307 {
+			t.Errorf("Should return a 307, but it returned %d", responseRecorder.Code)
+		}
+		if responseRecorder.HeaderMap.Get("Location") != "https://www.cats.com/grey" {
+			t.Errorf("Should return a redirect Location to https://www.cats.com/grey, but it returned %s", responseRecorder.HeaderMap.Get("Location"))
+		}
+
 		os.Remove(routefile.Name())
 	}
 }
+
+func TestRouteTableReload(t *testing.T) {
+	routefile, err := ioutil.TempFile("", "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(routefile.Name())
+
+	if _, err := routefile.WriteString(`{"www.cats.com": {"/": {"targets": [{"service": "cats-v1", "weight": 1}]}}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := routefile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := &routeTable{filename: routefile.Name()}
+	if _, err := routes.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("GET", "http://www.cats.com/tabby", nil)
+	route, _, err := routes.Director().Route(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := route.PickTarget(request); target.Service != "cats-v1" {
+		t.Errorf("expected cats-v1, got %s", target.Service)
+	}
+
+	// Shift the weights to a new variant, with a later modification time.
+	if err := ioutil.WriteFile(routefile.Name(), []byte(`{"www.cats.com": {"/": {"targets": [{"service": "cats-v1", "weight": 0}, {"service": "cats-v2", "weight": 1}]}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(routefile.Name(), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded, err := routes.reload(); err != nil || !reloaded {
+		t.Fatalf("expected the routes to be reloaded, got %t and %v", reloaded, err)
+	}
+
+	route, _, err = routes.Director().Route(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := route.PickTarget(request); target.Service != "cats-v2" {
+		t.Errorf("expected cats-v2 after reloading, got %s", target.Service)
+	}
+
+	// Invalid routes keep the current director.
+	if err := ioutil.WriteFile(routefile.Name(), []byte(`{"www.cats.com": {"/": {"targets": []}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(routefile.Name(), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := routes.reload(); err == nil {
+		t.Error("expected an error reloading invalid routes")
+	}
+	if _, _, err := routes.Director().Route(request); err != nil {
+		t.Errorf("expected the previous routes to be kept, got %v", err)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	mirrorServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- req
+		bodies <- string(body)
+	}))
+	defer mirrorServer.Close()
+	mirrorHost := strings.TrimPrefix(mirrorServer.URL, "http://")
+
+	mirrors := newMirror(MirrorConfig{QueueSize: 1, Workers: 1, MaxBody: 16, Timeout: time.Second}, http.DefaultTransport, nil)
+
+	request, _ := http.NewRequest("POST", "http://www.cats.com/tabby?a=1", strings.NewReader("meow"))
+	shadow := mirrors.prepare(request, mirrorHost)
+	if shadow == nil {
+		t.Fatal("expected a shadow request")
+	}
+
+	// The primary can still read the whole body.
+	if body, _ := ioutil.ReadAll(request.Body); string(body) != "meow" {
+		t.Errorf("expected the primary body to be meow, got %q", body)
+	}
+
+	mirrors.submit(shadow, nil)
+	select {
+	case mirrored := <-received:
+		if mirrored.Host != "www.cats.com" || mirrored.URL.RequestURI() != "/tabby?a=1" {
+			t.Errorf("expected a shadow request for www.cats.com/tabby?a=1, got %s%s", mirrored.Host, mirrored.URL.RequestURI())
+		}
+		if mirrored.Header.Get(ShadowHeader) != "1" {
+			t.Errorf("expected the %s header to be set", ShadowHeader)
+		}
+		if body := <-bodies; body != "meow" {
+			t.Errorf("expected the shadow body to be meow, got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mirror never received the shadow request")
+	}
+
+	// Bodies over the limit aren't mirrored, but are still passed to the primary in full.
+	long := strings.Repeat("meow", 10)
+	request, _ = http.NewRequest("POST", "http://www.cats.com/tabby", ioutil.NopCloser(strings.NewReader(long)))
+	if shadow := mirrors.prepare(request, mirrorHost); shadow != nil {
+		t.Error("expected no shadow request for a body over the limit")
+	}
+	if body, _ := ioutil.ReadAll(request.Body); string(body) != long {
+		t.Errorf("expected the primary body to be intact, got %q", body)
+	}
+}
+
+func TestRouterMetrics(t *testing.T) {
+	routefile, err := ioutil.TempFile("", "dogs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(routefile.Name())
+
+	if _, err := routefile.WriteString(`{"www.dogs.com": {"/": ">https://www.cats.com"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := routefile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := metrics.NewMemory()
+	router, err := NewKubernetesRouter(&Config{
+		RoutesFilename:    routefile.Name(),
+		DomainSuffixesRaw: ".invalid",
+		Metrics:           stats,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{"http://www.dogs.com/", "http://www.birds.test/", "http://cats.invalid/"} {
+		router.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	for _, test := range []struct {
+		name  string
+		tags  []string
+		count int64
+	}{
+		{"redirect_301", nil, 1},
+		{"requests", []string{"host:www.dogs.com", "route_kind:redirect", "route:/", "upstream:", "status_class:3xx"}, 1},
+		{"no_matching_service_error", nil, 2},
+		{"no_route_matched_no_fallback_enabled", nil, 1},
+		{"requests", []string{"host:other", "route_kind:none", "route:", "upstream:", "status_class:5xx"}, 1},
+		{"requests", []string{"host:*.invalid", "route_kind:domain_suffix", "route:", "upstream:", "status_class:5xx"}, 1},
+	} {
+		if count := stats.Counter(test.name, test.tags...); count != test.count {
+			t.Errorf("expected %s %v to be counted %d times, got %d", test.name, test.tags, test.count, count)
+		}
+	}
+
+	if inFlight := stats.GaugeValue("requests_in_flight"); inFlight != 0 {
+		t.Errorf("expected no requests in flight, got %v", inFlight)
+	}
+}
+
+// spanRecorder collects exported spans.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (r *spanRecorder) Export(span *tracing.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestRouterTracing(t *testing.T) {
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("Traceparent")
+	}))
+	defer upstream.Close()
+
+	spans := &spanRecorder{}
+	tracer, err := tracing.NewTracer(tracing.Config{SampleRate: 1, Propagation: []string{"tracecontext"}, Exporter: spans})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := NewKubernetesRouter(&Config{
+		Concurrency: 1,
+		Fallback: FallbackConfig{
+			Enable: true,
+			Scheme: "http",
+			Host:   strings.TrimPrefix(upstream.URL, "http://"),
+			Path:   "/",
+		},
+		Tracer: tracer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("GET", "http://www.cats.com/tabby", nil)
+	request.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.Handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	var names []string
+	byName := make(map[string]*tracing.Span)
+	for _, span := range spans.spans {
+		names = append(names, span.Name)
+		byName[span.Name] = span
+	}
+	if strings.Join(names, ",") != "route,semaphore_wait,upstream,request" {
+		t.Fatalf("unexpected spans %v", names)
+	}
+
+	root := byName["request"]
+	if root.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the trace to be continued, got %s", root.Context.TraceID)
+	}
+	if attributes := root.Attributes(); attributes["proxy.route_kind"] != "fallback" || attributes["http.response.status_code"] != 200 || attributes["server.address"] != "www.cats.com" {
+		t.Errorf("unexpected attributes %v", attributes)
+	}
+
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + byName["upstream"].Context.SpanID.String() + "-01"
+	if traceparent != expected {
+		t.Errorf("expected the upstream to get traceparent %s, got %s", expected, traceparent)
+	}
+}
+
+func TestRouterRequestID(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Get("X-Request-ID")
+	}))
+	defer upstream.Close()
+
+	router, err := NewKubernetesRouter(&Config{
+		Fallback: FallbackConfig{
+			Enable: true,
+			Scheme: "http",
+			Host:   strings.TrimPrefix(upstream.URL, "http://"),
+			Path:   "/",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("GET", "http://www.cats.com/tabby", nil)
+	request.Header.Set("X-Request-ID", "abc123")
+	responseRecorder := httptest.NewRecorder()
+	router.Handler.ServeHTTP(responseRecorder, request)
+	if forwarded != "abc123" || responseRecorder.Header().Get("X-Request-ID") != "abc123" {
+		t.Errorf("expected the request ID to be forwarded and returned, got %q and %q", forwarded, responseRecorder.Header().Get("X-Request-ID"))
+	}
+
+	// Errors from the proxy itself give the request ID.
+	router, err = NewKubernetesRouter(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseRecorder = httptest.NewRecorder()
+	router.Handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "http://www.birds.test/", nil))
+	id := responseRecorder.Header().Get("X-Request-ID")
+	if responseRecorder.Code != http.StatusBadGateway || id == "" || !strings.Contains(responseRecorder.Body.String(), "Request ID: "+id+"\n") {
+		t.Errorf("expected a 502 error page with the request ID %q, got %d %q", id, responseRecorder.Code, responseRecorder.Body.String())
+	}
+}
+
+func TestRouterForwardedHeaders(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHeader = req.Header
+	}))
+	defer upstream.Close()
+
+	router, err := NewKubernetesRouter(&Config{
+		TrustedProxiesRaw: "10.0.0.0/8",
+		Fallback: FallbackConfig{
+			Enable: true,
+			Scheme: "http",
+			Host:   strings.TrimPrefix(upstream.URL, "http://"),
+			Path:   "/",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		remoteAddr, expected string
+	}{
+		// A spoofed header from an untrusted peer is replaced.
+		{"203.0.113.195:41000", "203.0.113.195"},
+		// A trusted proxy's header is appended to.
+		{"10.0.0.2:41000", "1.2.3.4, 10.0.0.2"},
+	} {
+		request := httptest.NewRequest("GET", "http://www.cats.com/tabby", nil)
+		request.RemoteAddr = test.remoteAddr
+		request.Header.Set("X-Forwarded-For", "1.2.3.4")
+		router.Handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if got := upstreamHeader.Get("X-Forwarded-For"); got != test.expected {
+			t.Errorf("%s: expected the upstream to get X-Forwarded-For %q, got %q", test.remoteAddr, test.expected, got)
+		}
+		if got := upstreamHeader.Get("X-Forwarded-Host"); got != "www.cats.com" {
+			t.Errorf("%s: expected the upstream to get X-Forwarded-Host www.cats.com, got %q", test.remoteAddr, got)
+		}
+	}
+
+	if _, err := NewKubernetesRouter(&Config{TrustedProxiesRaw: "10.0.0.0/99"}); err == nil {
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestRouterHeaders(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHeader = req.Header
+		w.Header().Set("Server", "upstream")
+	}))
+	defer upstream.Close()
+
+	routefile, err := ioutil.TempFile("", "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(routefile.Name())
+
+	if _, err := routefile.WriteString(`{
+		"www.cats.com": {
+			"/tabby": {
+				"service": "/tabby",
+				"headers": {
+					"request": {"set": {"X-Original-Path": "{path}", "X-Client-IP": "{client_ip}"}, "remove": ["X-Debug"]},
+					"response": {"set": {"Strict-Transport-Security": "max-age=31536000"}, "remove": ["Server"]}
+				}
+			},
+			"/old": {
+				"redirect": {"location": "https://www.cats.com/"},
+				"headers": {"response": {"add": {"Cache-Control": "max-age=60"}}}
+			}
+		}
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := routefile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := NewKubernetesRouter(&Config{
+		RoutesFilename: routefile.Name(),
+		Static: StaticBackendConfig{
+			Enable: true,
+			Scheme: "http",
+			Host:   strings.TrimPrefix(upstream.URL, "http://"),
+			Path:   "/",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("GET", "http://www.cats.com/tabby/1", nil)
+	request.RemoteAddr = "203.0.113.195:41000"
+	request.Header.Set("X-Debug", "1")
+	response := httptest.NewRecorder()
+	router.Handler.ServeHTTP(response, request)
+
+	if got := upstreamHeader.Get("X-Original-Path"); got != "/tabby/1" {
+		t.Errorf("expected the upstream to get X-Original-Path /tabby/1, got %q", got)
+	}
+	if got := upstreamHeader.Get("X-Client-IP"); got != "203.0.113.195" {
+		t.Errorf("expected the upstream to get X-Client-IP 203.0.113.195, got %q", got)
+	}
+	if got := upstreamHeader.Get("X-Debug"); got != "" {
+		t.Errorf("expected X-Debug to be removed, got %q", got)
+	}
+	if got := response.Header().Get("Server"); got != "" {
+		t.Errorf("expected Server to be removed, got %q", got)
+	}
+	if got := response.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("expected Strict-Transport-Security to be set, got %q", got)
+	}
+
+	response = httptest.NewRecorder()
+	router.Handler.ServeHTTP(response, httptest.NewRequest("GET", "http://www.cats.com/old", nil))
+	if response.Code != http.StatusMovedPermanently || response.Header().Get("Cache-Control") != "max-age=60" {
+		t.Errorf("expected a redirect with Cache-Control max-age=60, got %d %v", response.Code, response.Header())
+	}
+}
+
+func TestRouterDebugHeaders(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHeader = req.Header
+	}))
+	defer upstream.Close()
+
+	for _, test := range []struct {
+		name         string
+		debug        DebugConfig
+		token        string
+		debugHeaders bool
+	}{
+		{"disabled", DebugConfig{}, "", false},
+		{"enabled", DebugConfig{Headers: true}, "", true},
+		{"signed", DebugConfig{Secret: "s3cret"}, DebugToken("s3cret", "www.cats.com", time.Now().Add(time.Minute)), true},
+		{"expired", DebugConfig{Secret: "s3cret"}, DebugToken("s3cret", "www.cats.com", time.Now().Add(-time.Minute)), false},
+		{"wrong secret", DebugConfig{Secret: "s3cret"}, DebugToken("guess", "www.cats.com", time.Now().Add(time.Minute)), false},
+		{"wrong host", DebugConfig{Secret: "s3cret"}, DebugToken("s3cret", "www.dogs.com", time.Now().Add(time.Minute)), false},
+		{"no secret", DebugConfig{}, DebugToken("", "www.cats.com", time.Now().Add(time.Minute)), false},
+		{"too long", DebugConfig{Secret: "s3cret"}, DebugToken("s3cret", "www.cats.com", time.Now().Add(DefaultDebugTokenLifetime+time.Minute)), false},
+		{"far future", DebugConfig{Secret: "s3cret"}, DebugToken("s3cret", "www.cats.com", time.Unix(9999999999, 0)), false},
+		{"longer lifetime", DebugConfig{Secret: "s3cret", MaxTokenLifetime: 24 * time.Hour}, DebugToken("s3cret", "www.cats.com", time.Now().Add(2*time.Hour)), true},
+		{"shorter lifetime", DebugConfig{Secret: "s3cret", MaxTokenLifetime: time.Minute}, DebugToken("s3cret", "www.cats.com", time.Now().Add(10*time.Minute)), false},
+	} {
+		router, err := NewKubernetesRouter(&Config{
+			Debug: test.debug,
+			Fallback: FallbackConfig{
+				Enable: true,
+				Scheme: "http",
+				Host:   strings.TrimPrefix(upstream.URL, "http://"),
+				Path:   "/",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := httptest.NewRequest("GET", "http://www.cats.com/tabby", nil)
+		request.Header.Set("X-Static-Root", "/spoofed/")
+		request.Header.Set("X-Original-URL", "/spoofed")
+		if test.token != "" {
+			request.Header.Set(debugHeader, test.token)
+		}
+		response := httptest.NewRecorder()
+		router.Handler.ServeHTTP(response, request)
+
+		if got := response.Header().Get("X-Kubernetes-Url") != ""; got != test.debugHeaders {
+			t.Errorf("%s: expected debug headers %t, got %t", test.name, test.debugHeaders, got)
+		}
+		for _, name := range internalHeaders {
+			if got := upstreamHeader.Get(name); got != "" {
+				t.Errorf("%s: expected %s to be stripped, got %q", test.name, name, got)
+			}
+		}
+	}
+}
+
+func TestRouterPathRewrite(t *testing.T) {
+	routefile, err := ioutil.TempFile("", "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(routefile.Name())
+
+	if _, err := routefile.WriteString(`{
+		"www.cats.com": {
+			"/projects/app1": {"service": "app1", "rewrite": {"strip": true}},
+			"/projects/app2/": {"service": "app2", "rewrite": {"replace": "/v2/"}},
+			"/projects/app3": {"service": "app3"}
+		}
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := routefile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := NewKubernetesRouter(&Config{
+		RoutesFilename:    routefile.Name(),
+		TrustedProxiesRaw: "10.0.0.0/8",
+		Kubernetes: KubernetesConfig{
+			Namespace: "default",
+			DNSDomain: "svc.invalid",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path, remoteAddr, givenPrefix, expectedPath, expectedPrefix string
+	}{
+		{"/projects/app1/story", "192.0.2.1:41000", "", "/story", "/projects/app1"},
+		{"/projects/app1/story", "10.0.0.2:41000", "/news/", "/story", "/news/projects/app1"},
+		{"/projects/app1/story", "192.0.2.1:41000", "/spoofed", "/story", "/projects/app1"},
+		{"/projects/app2/story", "192.0.2.1:41000", "", "/v2/story", "/projects/app2"},
+		{"/projects/app3/story", "192.0.2.1:41000", "", "/projects/app3/story", ""},
+	} {
+		request := httptest.NewRequest("GET", "http://www.cats.com"+test.path, nil)
+		request.RemoteAddr = test.remoteAddr
+		if test.givenPrefix != "" {
+			request.Header.Set("X-Forwarded-Prefix", test.givenPrefix)
+		}
+		router.Handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if request.URL.Path != test.expectedPath {
+			t.Errorf("%s: expected the upstream path %s, got %s", test.path, test.expectedPath, request.URL.Path)
+		}
+		if got := request.Header.Get("X-Forwarded-Prefix"); got != test.expectedPrefix {
+			t.Errorf("%s: expected X-Forwarded-Prefix %q, got %q", test.path, test.expectedPrefix, got)
+		}
+	}
+}
+
+func TestRouterCompression(t *testing.T) {
+	body := strings.Repeat("<p>The quick brown fox jumps over the lazy dog.</p>", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	routefile, err := ioutil.TempFile("", "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(routefile.Name())
+
+	if _, err := routefile.WriteString(`{
+		"www.cats.com": {
+			"/tabby": "/tabby",
+			"/calico": {"service": "/calico", "compress": false},
+			"/siamese": {"service": "/siamese", "compress": true}
+		}
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := routefile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		optIn    bool
+		path     string
+		expected string
+	}{
+		{false, "/tabby", "gzip"},
+		{false, "/calico", ""},
+		{false, "/siamese", "gzip"},
+		{true, "/tabby", ""},
+		{true, "/siamese", "gzip"},
+	} {
+		router, err := NewKubernetesRouter(&Config{
+			RoutesFilename:   routefile.Name(),
+			CompressionLevel: 4,
+			Compression: CompressionConfig{
+				OptIn:   test.optIn,
+				MinSize: 1000,
+			},
+			Static: StaticBackendConfig{
+				Enable: true,
+				Scheme: "http",
+				Host:   strings.TrimPrefix(upstream.URL, "http://"),
+				Path:   "/",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := httptest.NewRequest("GET", "http://www.cats.com"+test.path, nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		response := httptest.NewRecorder()
+		router.Handler.ServeHTTP(response, request)
+
+		if got := response.Header().Get("Content-Encoding"); got != test.expected {
+			t.Errorf("%s (opt in %t): expected Content-Encoding %q, got %q", test.path, test.optIn, test.expected, got)
+		}
+	}
+
+	if _, err := NewKubernetesRouter(&Config{Compression: CompressionConfig{TypesRaw: "text/html,nope"}}); err == nil {
+		t.Error("expected an error for an invalid media type")
+	}
+}
+
+func TestRouterDecompression(t *testing.T) {
+	body := strings.Repeat("<p>The quick brown fox jumps over the lazy dog.</p>", 100)
+	var buf bytes.Buffer
+	encoder := gzip.NewWriter(&buf)
+	encoder.Write([]byte(body))
+	encoder.Close()
+	compressed := buf.Bytes()
+
+	// The upstream sends gzip whatever the client accepts.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed)
+	}))
+	defer upstream.Close()
+
+	for _, test := range []struct {
+		recompress     bool
+		acceptEncoding string
+		expected       string
+	}{
+		{false, "", ""},
+		{false, "gzip", "gzip"},
+		{false, "br", ""},
+		{true, "br", "br"},
+		{true, "identity", ""},
+	} {
+		router, err := NewKubernetesRouter(&Config{
+			CompressionLevel: 4,
+			BrotliLevel:      4,
+			Compression: CompressionConfig{
+				MinSize:    1000,
+				Recompress: test.recompress,
+			},
+			Fallback: FallbackConfig{
+				Enable: true,
+				Scheme: "http",
+				Host:   strings.TrimPrefix(upstream.URL, "http://"),
+				Path:   "/",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := httptest.NewRequest("GET", "http://www.cats.com/lorem.gz", nil)
+		if test.acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		response := httptest.NewRecorder()
+		router.Handler.ServeHTTP(response, request)
+
+		if got := response.Header().Get("Content-Encoding"); got != test.expected {
+			t.Errorf("%q (recompress %t): expected Content-Encoding %q, got %q", test.acceptEncoding, test.recompress, test.expected, got)
+			continue
+		}
+
+		var decoded io.Reader = response.Body
+		switch test.expected {
+		case "gzip":
+			if decoded, err = gzip.NewReader(response.Body); err != nil {
+				t.Fatal(err)
+			}
+		case "br":
+			decoded = brotli.NewReader(response.Body)
+		}
+		got, err := ioutil.ReadAll(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Errorf("%q (recompress %t): body didn't survive the round trip", test.acceptEncoding, test.recompress)
+		}
+	}
+}
+
+func TestRouterShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A big queue keeps lines from being written before the shutdown.
+	filename := dir + "/access.log"
+	router, err := NewKubernetesRouter(&Config{
+		AccessLog: AccessLogConfig{
+			Sink:       accesslog.SinkConfig{Output: "file://" + filename},
+			BufferSize: 100,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://www.cats.com/tabby", nil))
+	if err := router.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(filename); !strings.Contains(string(b), "/tabby") {
+		t.Errorf("expected the access log to be written out on shutdown, got %q", b)
+	}
+
+	// Validating routes doesn't open the access log.
+	routesFilename := dir + "/routes.json"
+	if err := ioutil.WriteFile(routesFilename, []byte(`{"www.dogs.com": {"/": ">https://www.cats.com"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	validateFilename := dir + "/validate.log"
+	if _, err := NewKubernetesRouter(&Config{
+		RoutesFilename: routesFilename,
+		ValidateRoutes: true,
+		AccessLog: AccessLogConfig{
+			Sink: accesslog.SinkConfig{Output: "file://" + validateFilename},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(validateFilename); !os.IsNotExist(err) {
+		t.Errorf("expected validating routes not to create the access log, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/director"
+	"github.com/newsdev/kubernetes-dns-reverse-proxy/metrics"
+)
+
+// routeTable holds the director built from the routes file, which is swapped
+// out whenever the file is reloaded.
+type routeTable struct {
+	filename string
+	metrics  metrics.Metrics
+
+	mu       sync.RWMutex
+	director *director.Director
+	modTime  time.Time
+	size     int64
+}
+
+// loadDirector builds a director from a routes file.
+func loadDirector(filename string, m metrics.Metrics) (*director.Director, error) {
+
+	routesFile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	routesJSON, err := ioutil.ReadAll(routesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := routesFile.Close(); err != nil {
+		return nil, err
+	}
+
+	var routes map[string]map[string]director.Routes
+	if err := json.Unmarshal(routesJSON, &routes); err != nil {
+		return nil, err
+	}
+
+	dir := director.NewDirector(m)
+	for domain, prefixMap := range routes {
+		for prefix, prefixRoutes := range prefixMap {
+			if err := prefixRoutes.Validate(); err != nil {
+				return nil, fmt.Errorf("route %s%s: %s", domain, prefix, err)
+			}
+			dir.SetRoutes(domain, prefix, prefixRoutes...)
+		}
+	}
+
+	return dir, nil
+}
+
+// Director gets the current director.
+func (t *routeTable) Director() *director.Director {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.director
+}
+
+// reload rebuilds the director if the routes file has been modified since it
+// was last loaded, reporting whether it was. The current director is kept if
+// the file can't be read or fails validation.
+func (t *routeTable) reload() (bool, error) {
+	info, err := os.Stat(t.filename)
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.RLock()
+	unchanged := info.ModTime().Equal(t.modTime) && info.Size() == t.size
+	t.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	dir, err := loadDirector(t.filename, t.metrics)
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.Lock()
+	t.director = dir
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	t.mu.Unlock()
+
+	return true, nil
+}
+
+// watch reloads the routes file every interval, for as long as the process runs.
+func (t *routeTable) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := t.reload()
+		if err != nil {
+			t.metrics.Count("routes_reload", 1, []string{"result:error"})
+			log.Errorln("Error reloading routes:", t.filename, err)
+			continue
+		}
+		if reloaded {
+			t.metrics.Count("routes_reload", 1, []string{"result:success"})
+			log.Infoln("Reloaded routes:", t.filename)
+		}
+	}
+}
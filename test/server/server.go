@@ -50,7 +50,7 @@ func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		host := r.Host
 		w.Header().Set("content-length", strconv.Itoa(len(host)))
-		fmt.Fprintf(w, host)
+		fmt.Fprint(w, host)
 		log.Println("Test Server: ", r.URL.Path)
 	})
 
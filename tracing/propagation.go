@@ -0,0 +1,159 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Propagation headers.
+const (
+	TraceparentHeader  = "Traceparent"
+	B3Header           = "B3"
+	B3TraceIDHeader    = "X-B3-Traceid"
+	B3SpanIDHeader     = "X-B3-Spanid"
+	B3ParentSpanHeader = "X-B3-Parentspanid"
+	B3SampledHeader    = "X-B3-Sampled"
+	B3FlagsHeader      = "X-B3-Flags"
+)
+
+// decodeHex decodes an ID of exactly len(id)*2 lowercase hex digits. IDs of
+// all zeros are invalid.
+func decodeHex(id []byte, s string) bool {
+	if len(s) != len(id)*2 || strings.ToLower(s) != s {
+		return false
+	}
+	if _, err := hex.Decode(id, []byte(s)); err != nil {
+		return false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTraceparent parses a W3C traceparent header.
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four parts; later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	var flags [1]byte
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// parseB3TraceID parses a B3 trace ID, which may be 64 or 128 bits.
+func parseB3TraceID(id *TraceID, s string) bool {
+	if len(s) == 16 {
+		s = strings.Repeat("0", 16) + s
+	}
+	return decodeHex(id[:], s)
+}
+
+// parseB3Sampled parses a B3 sampling decision, where d means debug.
+func parseB3Sampled(s string) (*bool, bool) {
+	var sampled bool
+	switch s {
+	case "":
+		return nil, true
+	case "1", "d", "true":
+		sampled = true
+	case "0", "false":
+	default:
+		return nil, false
+	}
+	return &sampled, true
+}
+
+// parseB3 parses the single b3 header or the multiple X-B3 headers.
+func parseB3(header http.Header) (SpanContext, *bool, bool) {
+	var sc SpanContext
+
+	if single := header.Get(B3Header); single != "" {
+		parts := strings.Split(single, "-")
+
+		// A lone sampling decision carries no context to continue.
+		if len(parts) < 2 {
+			return sc, nil, false
+		}
+
+		var sampled *bool
+		ok := true
+		if len(parts) > 2 {
+			sampled, ok = parseB3Sampled(parts[2])
+		}
+		if !ok || !parseB3TraceID(&sc.TraceID, parts[0]) || !decodeHex(sc.SpanID[:], parts[1]) {
+			return sc, nil, false
+		}
+		return sc, sampled, true
+	}
+
+	if !parseB3TraceID(&sc.TraceID, header.Get(B3TraceIDHeader)) || !decodeHex(sc.SpanID[:], header.Get(B3SpanIDHeader)) {
+		return sc, nil, false
+	}
+	sampled, ok := parseB3Sampled(header.Get(B3SampledHeader))
+	if header.Get(B3FlagsHeader) == "1" {
+		sampled, ok = parseB3Sampled("d")
+	}
+	if !ok {
+		return sc, nil, false
+	}
+	return sc, sampled, true
+}
+
+// extract reads the trace context of a request in the first of the tracer's
+// propagation formats that's present and valid. sampled is nil if the caller
+// left the decision to us.
+func (t *Tracer) extract(header http.Header) (SpanContext, *bool, bool) {
+	if t.tracecontext {
+		if parent, ok := parseTraceparent(header.Get(TraceparentHeader)); ok {
+			sampled := parent.Sampled
+			return parent, &sampled, true
+		}
+	}
+	if t.b3 {
+		if parent, sampled, ok := parseB3(header); ok {
+			return parent, sampled, true
+		}
+	}
+	return SpanContext{}, nil, false
+}
+
+// inject writes a span context to a request's headers, replacing the
+// trace context it arrived with.
+func (t *Tracer) inject(sc SpanContext, header http.Header) {
+	flags := 0
+	sampled := "0"
+	if sc.Sampled {
+		flags = 1
+		sampled = "1"
+	}
+
+	if t.tracecontext {
+		header.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags))
+	}
+	if t.b3 {
+		header.Del(B3Header)
+		header.Del(B3ParentSpanHeader)
+		header.Del(B3FlagsHeader)
+		header.Set(B3TraceIDHeader, sc.TraceID.String())
+		header.Set(B3SpanIDHeader, sc.SpanID.String())
+		header.Set(B3SampledHeader, sampled)
+	}
+}
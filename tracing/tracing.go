@@ -0,0 +1,261 @@
+// Package tracing implements enough of OpenTelemetry tracing for the proxy:
+// W3C trace context and B3 propagation, sampling, and spans exported over OTLP.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SpanKind describes a span's relationship to the request, as in OTLP.
+type SpanKind int
+
+const (
+	Internal SpanKind = 1
+	Server   SpanKind = 2
+	Client   SpanKind = 3
+)
+
+// TraceID and SpanID identify traces and spans.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext is the part of a span that's propagated between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Exporter receives spans once they've ended. Export must not block.
+type Exporter interface {
+	Export(span *Span)
+}
+
+// Config describes how a tracer samples and propagates traces.
+type Config struct {
+	// SampleRate is the fraction of new traces that are sampled. Requests
+	// that arrive with a sampling decision keep it.
+	SampleRate float64
+
+	// Propagation lists the formats trace context is read from and written
+	// to upstreams in: tracecontext (W3C traceparent), b3 or both.
+	Propagation []string
+
+	// Exporter receives sampled spans.
+	Exporter Exporter
+}
+
+// Tracer starts spans for requests. A nil tracer traces nothing.
+type Tracer struct {
+	config           Config
+	tracecontext, b3 bool
+}
+
+// NewTracer creates a tracer.
+func NewTracer(config Config) (*Tracer, error) {
+	t := &Tracer{config: config}
+	for _, format := range config.Propagation {
+		switch format {
+		case "tracecontext":
+			t.tracecontext = true
+		case "b3":
+			t.b3 = true
+		default:
+			return nil, fmt.Errorf("unknown trace propagation format %q", format)
+		}
+	}
+	return t, nil
+}
+
+// Span is a timed operation in a trace. Its methods do nothing on a nil span,
+// and only sampled spans keep attributes and are exported.
+type Span struct {
+	tracer *Tracer
+
+	Context            SpanContext
+	Parent             SpanID
+	Name               string
+	Kind               SpanKind
+	StartTime, EndTime time.Time
+
+	// Failed and Message describe an error.
+	Failed  bool
+	Message string
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	ended      bool
+}
+
+type spanKey struct{}
+
+// FromContext gets the span in a context, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// FromRequest gets the span of a request, or nil.
+func FromRequest(req *http.Request) *Span {
+	return FromContext(req.Context())
+}
+
+// NewContext returns a copy of ctx holding span.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func randomBytes(b []byte) {
+	rand.Read(b)
+}
+
+// sample decides whether to sample a new trace.
+func (t *Tracer) sample() bool {
+	switch {
+	case t.config.SampleRate >= 1:
+		return true
+	case t.config.SampleRate <= 0:
+		return false
+	}
+
+	const precision = 1 << 30
+	n, err := rand.Int(rand.Reader, big.NewInt(precision))
+	if err != nil {
+		return false
+	}
+	return float64(n.Int64()) < t.config.SampleRate*precision
+}
+
+// StartRequest starts a server span for a request, continuing the trace in
+// its headers if there is one.
+func (t *Tracer) StartRequest(req *http.Request) *Span {
+	span := &Span{tracer: t, Name: "request", Kind: Server, StartTime: time.Now()}
+
+	if parent, sampled, ok := t.extract(req.Header); ok {
+		span.Context.TraceID = parent.TraceID
+		span.Parent = parent.SpanID
+		if sampled != nil {
+			span.Context.Sampled = *sampled
+		} else {
+			span.Context.Sampled = t.sample()
+		}
+	} else {
+		randomBytes(span.Context.TraceID[:])
+		span.Context.Sampled = t.sample()
+	}
+	randomBytes(span.Context.SpanID[:])
+
+	return span
+}
+
+// Handler traces each request to h in a server span, which the wrapped handler
+// can get with FromRequest.
+func (t *Tracer) Handler(h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		span := t.StartRequest(req)
+		defer span.End()
+		h.ServeHTTP(w, req.WithContext(NewContext(req.Context(), span)))
+	})
+}
+
+// Child starts a span within s.
+func (s *Span) Child(name string, kind SpanKind) *Span {
+	if s == nil {
+		return nil
+	}
+
+	child := &Span{
+		tracer:    s.tracer,
+		Parent:    s.Context.SpanID,
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+	}
+	child.Context.TraceID = s.Context.TraceID
+	child.Context.Sampled = s.Context.Sampled
+	randomBytes(child.Context.SpanID[:])
+	return child
+}
+
+// SetAttribute records a string, int or bool attribute of the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.Context.Sampled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// Attributes gets a copy of the span's attributes.
+func (s *Span) Attributes() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attributes := make(map[string]interface{}, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes[key] = value
+	}
+	return attributes
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Failed = true
+	s.Message = msg
+}
+
+// End ends the span, exporting it if it's sampled. Only the first call has
+// any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Sampled && s.tracer.config.Exporter != nil {
+		s.tracer.config.Exporter.Export(s)
+	}
+}
+
+// Inject writes the span's context to the headers of a request to an
+// upstream, in each of the tracer's propagation formats.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	s.tracer.inject(s.Context, header)
+}
@@ -0,0 +1,215 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects exported spans.
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) Export(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func newTestTracer(t *testing.T, sampleRate float64, propagation ...string) (*Tracer, *recorder) {
+	r := &recorder{}
+	tracer, err := NewTracer(Config{SampleRate: sampleRate, Propagation: propagation, Exporter: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracer, r
+}
+
+func TestExtract(t *testing.T) {
+	tracer, _ := newTestTracer(t, 0, "tracecontext", "b3")
+
+	for _, test := range []struct {
+		header  http.Header
+		traceID string
+		spanID  string
+		sampled string
+	}{
+		{
+			header:  http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}},
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", sampled: "true",
+		},
+		{
+			header:  http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}},
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", sampled: "false",
+		},
+		{
+			header:  http.Header{"B3": {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"}},
+			traceID: "80f198ee56343ba864fe8b2a57d3eff7", spanID: "e457b5a2e4d86bd1", sampled: "true",
+		},
+		{
+			header: http.Header{
+				"X-B3-Traceid": {"64fe8b2a57d3eff7"},
+				"X-B3-Spanid":  {"e457b5a2e4d86bd1"},
+			},
+			traceID: "000000000000000064fe8b2a57d3eff7", spanID: "e457b5a2e4d86bd1", sampled: "unset",
+		},
+		// Invalid headers start a new trace.
+		{header: http.Header{"Traceparent": {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}}},
+		{header: http.Header{"Traceparent": {"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"}}},
+		{header: http.Header{"B3": {"1"}}},
+		{header: http.Header{}},
+	} {
+		parent, sampled, ok := tracer.extract(test.header)
+		if test.traceID == "" {
+			if ok {
+				t.Errorf("%v: expected no trace context, got %+v", test.header, parent)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%v: expected a trace context", test.header)
+			continue
+		}
+
+		sampledString := "unset"
+		if sampled != nil && *sampled {
+			sampledString = "true"
+		} else if sampled != nil {
+			sampledString = "false"
+		}
+		if parent.TraceID.String() != test.traceID || parent.SpanID.String() != test.spanID || sampledString != test.sampled {
+			t.Errorf("%v: expected %s %s %s, got %s %s %s", test.header, test.traceID, test.spanID, test.sampled, parent.TraceID, parent.SpanID, sampledString)
+		}
+	}
+
+	if _, err := NewTracer(Config{Propagation: []string{"jaeger"}}); err == nil {
+		t.Error("expected an error for an unknown propagation format")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tracer, r := newTestTracer(t, 0, "tracecontext", "b3")
+
+	var upstream http.Header
+	handler := tracer.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		span := FromRequest(req).Child("upstream", Client)
+		span.SetAttribute("server.address", "app.default.svc.cluster.local")
+		upstream = http.Header{}
+		span.Inject(upstream)
+		span.End()
+	}))
+
+	// The caller's sampling decision is kept even though the sample rate is 0.
+	req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(r.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(r.spans))
+	}
+	child, root := r.spans[0], r.spans[1]
+	if root.Name != "request" || root.Kind != Server || root.Parent.String() != "00f067aa0ba902b7" {
+		t.Errorf("unexpected root span %+v", root)
+	}
+	if child.Parent != root.Context.SpanID || child.Context.TraceID != root.Context.TraceID {
+		t.Errorf("expected the upstream span to be a child of the root span")
+	}
+	if child.Attributes()["server.address"] != "app.default.svc.cluster.local" {
+		t.Errorf("unexpected attributes %v", child.Attributes())
+	}
+
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + child.Context.SpanID.String() + "-01"
+	if upstream.Get("Traceparent") != expected {
+		t.Errorf("expected traceparent %s, got %s", expected, upstream.Get("Traceparent"))
+	}
+	if upstream.Get("X-B3-Traceid") != "4bf92f3577b34da6a3ce929d0e0e4736" || upstream.Get("X-B3-Sampled") != "1" {
+		t.Errorf("unexpected B3 headers %v", upstream)
+	}
+
+	// New traces follow the sample rate, but are still propagated.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://www.example.com/", nil))
+	if len(r.spans) != 2 {
+		t.Errorf("expected unsampled spans not to be exported, got %d spans", len(r.spans))
+	}
+	if traceparent := upstream.Get("Traceparent"); len(traceparent) != 55 || traceparent[53:] != "00" {
+		t.Errorf("expected an unsampled traceparent, got %q", traceparent)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", req.URL.Path, req.Header.Get("Content-Type"))
+		}
+		var request otlpRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL+"/v1/traces", "proxy", time.Hour)
+	tracer, err := NewTracer(Config{SampleRate: 1, Exporter: exporter})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	span := tracer.StartRequest(httptest.NewRequest("GET", "http://www.example.com/", nil))
+	span.SetAttribute("http.response.status_code", 502)
+	span.SetError("Bad Gateway")
+	span.End()
+	exporter.Close()
+
+	// Close only returns once the queued spans have been sent.
+	var request otlpRequest
+	select {
+	case request = <-requests:
+	default:
+		t.Fatal("expected Close to send the queued spans")
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	if service := request.ResourceSpans[0].Resource.Attributes[0]; service.Key != "service.name" || *service.Value.StringValue != "proxy" {
+		t.Errorf("unexpected resource attribute %+v", service)
+	}
+
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	s := spans[0]
+	if s.TraceID != span.Context.TraceID.String() || s.Name != "request" || s.Kind != Server || s.ParentSpanID != "" {
+		t.Errorf("unexpected span %+v", s)
+	}
+	if s.Status.Code != 2 || s.Status.Message != "Bad Gateway" {
+		t.Errorf("unexpected status %+v", s.Status)
+	}
+	if len(s.Attributes) != 1 || *s.Attributes[0].Value.IntValue != "502" {
+		t.Errorf("unexpected attributes %+v", s.Attributes)
+	}
+
+	// An interval that isn't positive falls back to the default.
+	for _, interval := range []time.Duration{0, -time.Second} {
+		exporter := NewOTLPExporter(collector.URL+"/v1/traces", "proxy", interval)
+		tracer, err := NewTracer(Config{SampleRate: 1, Exporter: exporter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracer.StartRequest(httptest.NewRequest("GET", "http://www.example.com/", nil)).End()
+		exporter.Close()
+
+		select {
+		case <-requests:
+		default:
+			t.Errorf("interval %s: expected Close to send the queued spans", interval)
+		}
+	}
+}